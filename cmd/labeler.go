@@ -4,6 +4,8 @@ import (
 	"log"
 	"os"
 	"os/user"
+	"reflect"
+	"strings"
 
 	c "github.com/clubanderson/labeler/pkg/common"
 	h "github.com/clubanderson/labeler/pkg/helpers"
@@ -22,6 +24,17 @@ func main() {
 	p.HomeDir = currentUser.HomeDir
 	p.Path = os.Getenv("PATH")
 
+	// transform works the same with piped input or with -f files and never needs a cluster, post-render is the
+	// hidden transform that helm runs as --post-renderer for 'h install/upgrade --l-post-render'
+	if len(os.Args) > 1 && (os.Args[1] == "transform" || os.Args[1] == "post-render") {
+		h.TransformRun(os.Args[1:], p)
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "krm" {
+		h.KRMRun(os.Args[1:], p)
+		return
+	}
+
 	if !h.IsInputFromPipe() {
 		if len(os.Args) <= 1 {
 			args := []string{os.Args[0], "kubectl", "--l-help"}
@@ -37,64 +50,128 @@ func main() {
 				h.AliasRun(args[1:], p)
 			}
 
+			if args[0] == "retry" {
+				h.RetryRun(args, p)
+				return
+			}
+			if args[0] == "undo" {
+				h.UndoRun(args, p)
+				return
+			}
+			if args[0] == "shell-init" {
+				h.ShellInitRun(args, p)
+				return
+			}
+
 			if len(args) > 0 {
 				if args[0] == "k" || args[0] == "h" || args[0] == "kubectl" || args[0] == "helm" {
 					// log.Println("labeler.go: invoked as alias: ")
 					h.AliasRun(args, p)
+				} else {
+					// the standalone command labels the objects in a file, directory or kustomization
+					for _, arg := range args {
+						if arg == "-"+c.FlagsName.FileShort || strings.HasPrefix(arg, "-"+c.FlagsName.FileShort+"=") || strings.HasPrefix(arg, "--"+c.FlagsName.File) {
+							runRootCmd(p)
+							return
+						}
+					}
 				}
 			}
 		}
+	} else if len(os.Args) > 1 && (os.Args[1] == "k" || os.Args[1] == "h" || os.Args[1] == "kubectl" || os.Args[1] == "helm") {
+		// 'cat x.yaml | k apply -f -' pipes the manifests to kubectl, not to labeler
+		h.AliasRun(os.Args[1:], p)
 	} else {
 		// requires labeler-piped.go - this 'else' can be removed if only using aliased commands
-		var versionFlag bool
-
-		var rootCmd = &cobra.Command{
-			SilenceErrors: true,
-			SilenceUsage:  true,
-			Use:           "labeler",
-			Short:         "label all kubernetes resources with provided key/value pair",
-			Long:          `Utility that automates the labeling of resources output from kubectl, kustomize, and helm`,
-			Run: func(cmd *cobra.Command, args []string) {
-				if versionFlag {
-					log.Printf("labeler version %v\n", c.Version)
-					return
-				}
-				if c.Flags.Label == "" {
-					log.Println("labeler.go: no label provided")
-					os.Exit(1)
-				}
+		runRootCmd(p)
+	}
+}
 
-				print = logNoop
-				if c.Flags.Verbose {
-					print = logOut
-				}
-				p.ClientSet, p.RestConfig, p.DynamicClient = h.SwitchContext(p)
+// runRootCmd runs labeler as a standalone command that labels the objects in piped input or in --file
+func runRootCmd(p c.ParamsStruct) {
+	var versionFlag bool
 
-				h.DetectInput(p)
-			},
-		}
+	var rootCmd = &cobra.Command{
+		SilenceErrors: true,
+		SilenceUsage:  true,
+		Use:           "labeler",
+		Short:         "label all kubernetes resources with provided key/value pair",
+		Long: `Utility that automates the labeling of resources output from kubectl, kustomize, and helm
+
+Piped manifests are labeled as each document is read. A single List document, helm output, and the objects of
+--l-atomic runs and of plugins that need all objects (--l-mw-name, --l-bp-name, --l-remote-contexts) are held in
+memory.`,
+		// the --l-* args of the plugins are not cobra flags, they are parsed like in alias mode
+		FParseErrWhitelist: cobra.FParseErrWhitelist{UnknownFlags: true},
+		Run: func(cmd *cobra.Command, args []string) {
+			if versionFlag {
+				log.Printf("labeler version %v\n", c.Version)
+				return
+			}
+			if c.Flags.Label == "" && c.Flags.Annotation == "" && !hasPluginArgs(os.Args[1:]) {
+				log.Println("labeler.go: no label, annotation or plugin argument provided")
+				os.Exit(1)
+			}
+
+			p.Flags = make(map[string]bool)
+			p.Params = make(map[string]string)
+			p.Resources = make(map[c.ResourceStruct][]byte)
+			p.PluginArgs = make(map[string][]string)
+			p.PluginPtrs = make(map[string]reflect.Value)
+
+			print = logNoop
+			if c.Flags.Verbose {
+				print = logOut
+			}
+			h.DetectInput(p)
+		},
+	}
+
+	rootCmd.SetFlagErrorFunc(func(cmd *cobra.Command, err error) error {
+		cmd.Println(err)
+		cmd.Println(cmd.UsageString())
+		return SilentErr(err)
+	})
+	rootCmd.Flags().BoolVar(&versionFlag, "version", false, "print the version")
+	rootCmd.PersistentFlags().StringVarP(&c.Flags.Filepath, c.FlagsName.File, c.FlagsName.FileShort, "", "file, directory or kustomization directory with the manifests of the objects to label")
+	rootCmd.PersistentFlags().BoolVarP(&c.Flags.Recursive, c.FlagsName.Recursive, c.FlagsName.RecursiveShort, false, "read the --file directory recursively")
+	rootCmd.PersistentFlags().StringVarP(&c.Flags.Label, c.FlagsName.Label, c.FlagsName.LabelShort, "", "label to apply to all resources e.g. -l app.kubernetes.io/part-of=sample-value")
+	rootCmd.PersistentFlags().StringVarP(&c.Flags.Annotation, c.FlagsName.Annotation, c.FlagsName.AnnotationShort, "", "annotation to apply to all resources e.g. --annotation=creator='John Doe'")
+	rootCmd.PersistentFlags().StringVarP(&c.Flags.Kubeconfig, c.FlagsName.Kubeconfig, c.FlagsName.KubeconfigShort, "", "kubeconfig to use")
+	rootCmd.PersistentFlags().StringVarP(&c.Flags.Context, c.FlagsName.Context, c.FlagsName.ContextShort, "", "context to use")
+	rootCmd.PersistentFlags().StringVar(&c.Flags.Server, c.FlagsName.Server, "", "address of the API server, overrides the kubeconfig")
+	rootCmd.PersistentFlags().StringVar(&c.Flags.Token, c.FlagsName.Token, "", "bearer token to authenticate to the API server with, overrides the kubeconfig")
+	rootCmd.PersistentFlags().BoolVarP(&c.Flags.Verbose, c.FlagsName.Verbose, c.FlagsName.VerboseShort, false, "log verbose output")
+	rootCmd.PersistentFlags().BoolVarP(&c.Flags.Debug, c.FlagsName.Debug, c.FlagsName.DebugShort, false, "debug mode")
+	rootCmd.PersistentFlags().BoolVarP(&c.Flags.Overwrite, c.FlagsName.Overwrite, c.FlagsName.OverwriteShort, false, "overwrite mode")
+	rootCmd.PersistentFlags().StringVar(&c.Flags.Wait, c.FlagsName.Wait, "", "keep retrying objects that do not exist yet for up to this long e.g. --l-wait=2m")
+	rootCmd.PersistentFlags().BoolVar(&c.Flags.Atomic, c.FlagsName.Atomic, false, "label all resources or none of them, all objects are held in memory")
+	rootCmd.PersistentFlags().StringVar(&c.Flags.ExportPath, c.FlagsName.ExportPath, "", "write the operations that could not be applied to this file or directory")
+	rootCmd.PersistentFlags().StringVar(&c.Flags.ExportFormat, c.FlagsName.ExportFormat, "", "format of --l-export-pending: script (default), patches or kustomize")
+	rootCmd.PersistentFlags().StringVar(&c.Flags.DiscoveryCacheDir, c.FlagsName.DiscoveryCacheDir, "", "directory to cache API discovery in (default ~/.labeler/cache)")
+	rootCmd.PersistentFlags().StringVar(&c.Flags.DiscoveryCacheTTL, c.FlagsName.DiscoveryCacheTTL, "", "how long cached API discovery is used before it is refreshed (default 60s)")
+	rootCmd.PersistentFlags().BoolVar(&c.Flags.Tee, c.FlagsName.Tee, false, "echo the piped input to stdout unchanged while labeling it, labeler and plugin output goes to stderr")
+	rootCmd.PersistentFlags().StringVar(&c.Flags.JournalConfigMap, c.FlagsName.JournalConfigMap, "", "also keep the undo journal of this run in a configmap e.g. --l-journal-configmap=kube-system/labeler-journal")
+	rootCmd.PersistentFlags().StringVar(&c.Flags.As, c.FlagsName.As, "", "label as this user, like kubectl --as")
+	rootCmd.PersistentFlags().StringArrayVar(&c.Flags.AsGroups, c.FlagsName.AsGroup, nil, "label as a member of this group, like kubectl --as-group, may be repeated")
+	rootCmd.PersistentFlags().StringVar(&c.Flags.AsUID, c.FlagsName.AsUID, "", "label as this UID, like kubectl --as-uid")
+	rootCmd.PersistentFlags().StringVar(&c.Flags.User, c.FlagsName.User, "", "kubeconfig user to label with, like kubectl --user")
+
+	err := rootCmd.Execute()
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+}
 
-		rootCmd.SetFlagErrorFunc(func(cmd *cobra.Command, err error) error {
-			cmd.Println(err)
-			cmd.Println(cmd.UsageString())
-			return SilentErr(err)
-		})
-		rootCmd.Flags().BoolVar(&versionFlag, "version", false, "print the version")
-		// rootCmd.Flags().StringVarP(&flags.filepath, flagsName.file, flagsName.fileShort, "", "path to the file")
-		rootCmd.PersistentFlags().StringVarP(&c.Flags.Label, c.FlagsName.Label, c.FlagsName.LabelShort, "", "label to apply to all resources e.g. -l app.kubernetes.io/part-of=sample-value")
-		rootCmd.PersistentFlags().StringVarP(&c.Flags.Annotation, c.FlagsName.Annotation, c.FlagsName.AnnotationShort, "", "annotation to apply to all resources e.g. --annotation=creator='John Doe'")
-		rootCmd.PersistentFlags().StringVarP(&c.Flags.Kubeconfig, c.FlagsName.Kubeconfig, c.FlagsName.KubeconfigShort, "", "kubeconfig to use")
-		rootCmd.PersistentFlags().StringVarP(&c.Flags.Context, c.FlagsName.Context, c.FlagsName.ContextShort, "", "context to use")
-		rootCmd.PersistentFlags().BoolVarP(&c.Flags.Verbose, c.FlagsName.Verbose, c.FlagsName.VerboseShort, false, "log verbose output")
-		rootCmd.PersistentFlags().BoolVarP(&c.Flags.Debug, c.FlagsName.Debug, c.FlagsName.DebugShort, false, "debug mode")
-		rootCmd.PersistentFlags().BoolVarP(&c.Flags.Overwrite, c.FlagsName.Overwrite, c.FlagsName.OverwriteShort, false, "overwrite mode")
-
-		err = rootCmd.Execute()
-		if err != nil {
-			log.Println(err)
-			os.Exit(1)
+// hasPluginArgs reports whether args has a plugin arg, e.g. --l-bp-name=y
+func hasPluginArgs(args []string) bool {
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "--l-") {
+			return true
 		}
 	}
+	return false
 }
 
 func SilentErr(error) error {
@@ -10,6 +10,7 @@ import (
 	"os"
 	"os/exec"
 	"os/user"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"time"
@@ -32,11 +33,18 @@ type Plugin interface {
 }
 
 type ResourceStruct struct {
-	Group      string
-	Version    string
-	Resource   string
-	Namespace  string
-	ObjectName string
+	Group      string `json:"group"`
+	Version    string `json:"version"`
+	Resource   string `json:"resource"`
+	Namespace  string `json:"namespace,omitempty"`
+	ObjectName string `json:"name"`
+}
+
+// PendingStruct holds the labels and annotations that could not be applied to an object because it did not exist yet
+type PendingStruct struct {
+	Resource    ResourceStruct    `json:"resource"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
 }
 
 type ParamsStruct struct {
@@ -44,37 +52,134 @@ type ParamsStruct struct {
 	Path          string
 	OriginalCmd   string
 	Kubeconfig    string
-	ClientSet     *kubernetes.Clientset
+	ClientSet     kubernetes.Interface
 	RestConfig    *rest.Config
-	DynamicClient *dynamic.DynamicClient
+	DynamicClient dynamic.Interface
 	Flags         map[string]bool
 	Params        map[string]string
 	Resources     map[ResourceStruct][]byte
 	PluginArgs    map[string][]string
 	PluginPtrs    map[string]reflect.Value
+	// WaitDeadline is when the current phase of a run stops waiting for objects to exist (--l-wait)
+	WaitDeadline time.Time
 }
 
 type ResultsStruct struct {
-	DidNotLabel    []string
-	DidNotAnnotate []string
+	DidNotLabel      []string
+	DidNotAnnotate   []string
+	FailedToLabel    []string
+	FailedToAnnotate []string
+	Pending          []PendingStruct
+	Skipped          []PendingStruct
+	// Kinds are the kinds of the resources of the objects seen in the run, so that exporting the pending operations
+	// does not need the cluster to look them up
+	Kinds map[schema.GroupVersionResource]string
 }
 
 var RunResults ResultsStruct
 
+// DeferLabel records a label that can be applied once the object exists
+func (r *ResultsStruct) DeferLabel(resource ResourceStruct, key, val string) {
+	pendingFor(&r.Pending, resource).Labels[key] = val
+}
+
+// DeferAnnotation records an annotation that can be applied once the object exists
+func (r *ResultsStruct) DeferAnnotation(resource ResourceStruct, key, val string) {
+	pendingFor(&r.Pending, resource).Annotations[key] = val
+}
+
+// SkipLabel records a label that labeler deliberately did not apply (e.g. to the default namespace)
+func (r *ResultsStruct) SkipLabel(resource ResourceStruct, key, val string) {
+	pendingFor(&r.Skipped, resource).Labels[key] = val
+}
+
+// SkipAnnotation records an annotation that labeler deliberately did not apply (e.g. to the default namespace)
+func (r *ResultsStruct) SkipAnnotation(resource ResourceStruct, key, val string) {
+	pendingFor(&r.Skipped, resource).Annotations[key] = val
+}
+
+// RecordKind records the kind of a resource seen in the run
+func (r *ResultsStruct) RecordKind(gvr schema.GroupVersionResource, kind string) {
+	if r.Kinds == nil {
+		r.Kinds = map[schema.GroupVersionResource]string{}
+	}
+	r.Kinds[gvr] = kind
+}
+
+// PrintSummary lists the labels and annotations of the run that could not be applied, once all plugins are done
+func (r *ResultsStruct) PrintSummary() {
+	if len(r.DidNotLabel) > 0 {
+		log.Printf("\nlabeler.go: The following resources can be labeled at a later time:\n\n")
+		for _, cmd := range r.DidNotLabel {
+			log.Printf("%v", cmd)
+		}
+	}
+	if len(r.FailedToLabel) > 0 {
+		log.Printf("\nlabeler.go: The following resources failed to be labeled:\n\n")
+		for _, failure := range r.FailedToLabel {
+			log.Printf("%v", failure)
+		}
+	}
+	if len(r.DidNotAnnotate) > 0 {
+		log.Printf("\nlabeler.go: The following resources can be annotated at a later time:\n\n")
+		for _, cmd := range r.DidNotAnnotate {
+			log.Printf("%v", cmd)
+		}
+	}
+	if len(r.FailedToAnnotate) > 0 {
+		log.Printf("\nlabeler.go: The following resources failed to be annotated:\n\n")
+		for _, failure := range r.FailedToAnnotate {
+			log.Printf("%v", failure)
+		}
+	}
+}
+
+func pendingFor(ops *[]PendingStruct, resource ResourceStruct) *PendingStruct {
+	for i := range *ops {
+		if (*ops)[i].Resource == resource {
+			return &(*ops)[i]
+		}
+	}
+	*ops = append(*ops, PendingStruct{
+		Resource:    resource,
+		Labels:      map[string]string{},
+		Annotations: map[string]string{},
+	})
+	return &(*ops)[len(*ops)-1]
+}
+
 var Flags struct {
 	Filepath   string
+	Recursive  bool
 	Debug      bool
 	Verbose    bool
 	Label      string
 	Annotation string
 	Kubeconfig string
 	Context    string
+	Server     string
+	Token      string
 	Overwrite  bool
+	Wait       string
+	Atomic     bool
+	ExportPath string
+	Tee        bool
+
+	ExportFormat      string
+	DiscoveryCacheDir string
+	DiscoveryCacheTTL string
+	JournalConfigMap  string
+	As                string
+	AsGroups          []string
+	AsUID             string
+	User              string
 }
 
 var FlagsName = struct {
 	File            string
 	FileShort       string
+	Recursive       string
+	RecursiveShort  string
 	Verbose         string
 	VerboseShort    string
 	Debug           string
@@ -87,11 +192,28 @@ var FlagsName = struct {
 	KubeconfigShort string
 	Context         string
 	ContextShort    string
+	Server          string
+	Token           string
 	Overwrite       string
 	OverwriteShort  string
+	Wait            string
+	Atomic          string
+	ExportPath      string
+	ExportFormat    string
+	Tee             string
+
+	DiscoveryCacheDir string
+	DiscoveryCacheTTL string
+	JournalConfigMap  string
+	As                string
+	AsGroup           string
+	AsUID             string
+	User              string
 }{
 	File:            "file",
 	FileShort:       "f",
+	Recursive:       "recursive",
+	RecursiveShort:  "R",
 	Verbose:         "verbose",
 	VerboseShort:    "v",
 	Debug:           "debug",
@@ -104,8 +226,46 @@ var FlagsName = struct {
 	KubeconfigShort: "k",
 	Context:         "context",
 	ContextShort:    "c",
+	Server:          "server",
+	Token:           "token",
 	Overwrite:       "overwrite",
 	OverwriteShort:  "o",
+	Wait:            "l-wait",
+	Atomic:          "l-atomic",
+	ExportPath:      "l-export-pending",
+	ExportFormat:    "l-export-format",
+	Tee:             "l-tee",
+
+	DiscoveryCacheDir: "l-discovery-cache-dir",
+	DiscoveryCacheTTL: "l-discovery-cache-ttl",
+	JournalConfigMap:  "l-journal-configmap",
+	As:                "l-as",
+	AsGroup:           "l-as-group",
+	AsUID:             "l-as-uid",
+	User:              "l-user",
+}
+
+// GlobalFlags are the --l- args of labeler itself rather than of a plugin, they do not trigger any plugin. Like the
+// plugin args they are "name,type,description".
+var GlobalFlags = []string{
+	"l-wait,string,keep retrying objects that do not exist yet with exponential backoff for up to this long (usage: --l-wait=2m)",
+	"l-collection,string,with labeler retry only apply the pending operations of this collection, the label that was applied (usage: --l-collection=app.kubernetes.io/part-of=sample-app)",
+	"l-journal-configmap,string,also keep the undo journal of this run in a configmap (usage: --l-journal-configmap=kube-system/labeler-journal)",
+	"l-force,flag,with labeler undo also restore the values that were changed since the run",
+	"l-atomic,flag,check every patch with a server dry run first and roll back on failure so that all objects or none are labeled and annotated (all objects are held in memory)",
+	"l-export-pending,string,write the operations that could not be applied to a file or directory (usage: --l-export-pending=./pending.sh)",
+	"l-export-format,string,format of --l-export-pending: script (default) or patches or kustomize (usage: --l-export-format=kustomize)",
+	"l-post-render,flag,have helm install and upgrade create the objects with the labels and annotations by registering labeler as --post-renderer, labeling afterwards only verifies them",
+	"l-pre-apply,flag,inject the labels and annotations into the -f or -k manifests and apply them with kubectl apply -f - so that the objects are created labeled, labeling afterwards only verifies them",
+	"l-pod-template,flag,with --l-pre-apply or --l-post-render also label the pod templates of workloads",
+	"l-discovery-cache-dir,string,directory to cache API discovery in (usage: --l-discovery-cache-dir=~/.kube/cache, default ~/.labeler/cache)",
+	"l-discovery-cache-ttl,string,how long cached API discovery is used before it is refreshed (usage: --l-discovery-cache-ttl=1h, default 60s)",
+	"l-as,string,in piped mode label as this user like kubectl --as (usage: --l-as=system:serviceaccount:team-a:deployer)",
+	"l-as-group,string,in piped mode label as a member of this group like kubectl --as-group, may be repeated (usage: --l-as-group=team-a)",
+	"l-as-uid,string,in piped mode label as this UID like kubectl --as-uid",
+	"l-user,string,in piped mode use this kubeconfig user like kubectl --user",
+	"l-token,string,in piped mode authenticate with this bearer token like kubectl --token",
+	"l-tee,flag,in piped mode echo the input to stdout unchanged while labeling it, labeler and plugin output goes to stderr",
 }
 
 type Metadata struct {
@@ -118,13 +278,48 @@ type Namespace struct {
 	Metadata   Metadata `yaml:"metadata"`
 }
 
+// StateDir returns the directory labeler keeps its local state (pending queue, journal) in
+func StateDir(homeDir string) string {
+	return filepath.Join(homeDir, ".labeler")
+}
+
+// KeyValues parses a comma-separated list of key=value pairs, as given to --label, --l-annotation and the KRM function
+// config. Spaces around the pairs are dropped, pairs without a key are ignored.
+func KeyValues(s string) map[string]string {
+	values := map[string]string{}
+	for _, kv := range strings.Split(s, ",") {
+		key, val, found := strings.Cut(strings.TrimSpace(kv), "=")
+		if found && key != "" {
+			values[key] = val
+		}
+	}
+	return values
+}
+
 func (p ParamsStruct) RunCmd(cmdToRun string, cmdArgs []string, suppressOutput bool) ([]byte, error) {
+	return p.RunCmdWithStdin(cmdToRun, cmdArgs, suppressOutput, os.Stdin)
+}
+
+// RunCmdWithStdin runs a command like RunCmd, with stdin read from the given reader
+func (p ParamsStruct) RunCmdWithStdin(cmdToRun string, cmdArgs []string, suppressOutput bool, stdin io.Reader) ([]byte, error) {
 	cmdArgs = expandTilde(cmdArgs)
 
 	cmd := exec.Command(cmdToRun, cmdArgs...)
 	cmd.Env = append(cmd.Env, "PATH="+p.Path)
 	cmd.Env = append(cmd.Env, "HOME="+p.HomeDir)
-	cmd.Env = append(cmd.Env, "KUBECONFIG="+os.Getenv("KUBECONFIG"))
+	// the kubeconfig labeler itself uses, or the service account of the pod labeler runs in
+	kubeconfig := os.Getenv("KUBECONFIG")
+	if Flags.Kubeconfig != "" {
+		kubeconfig = Flags.Kubeconfig
+	}
+	cmd.Env = append(cmd.Env, "KUBECONFIG="+kubeconfig)
+	// the service of the cluster labeler runs in, and the context and API server helm reads from its environment (labeler
+	// resolves the cluster of a run from them, the helm it runs has to use the same)
+	for _, name := range []string{"KUBERNETES_SERVICE_HOST", "KUBERNETES_SERVICE_PORT", "HELM_KUBECONTEXT", "HELM_KUBEAPISERVER"} {
+		if value, ok := os.LookupEnv(name); ok {
+			cmd.Env = append(cmd.Env, name+"="+value)
+		}
+	}
 
 	var outputBuf bytes.Buffer
 	if suppressOutput {
@@ -133,7 +328,7 @@ func (p ParamsStruct) RunCmd(cmdToRun string, cmdArgs []string, suppressOutput b
 		cmd.Stdout = io.MultiWriter(&outputBuf, os.Stdout)
 	}
 	cmd.Stderr = io.MultiWriter(&outputBuf, os.Stderr)
-	cmd.Stdin = os.Stdin
+	cmd.Stdin = stdin
 
 	err := cmd.Start()
 	if err != nil {
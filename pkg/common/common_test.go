@@ -0,0 +1,28 @@
+package common
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestKeyValues(t *testing.T) {
+	tests := []struct {
+		input string
+		want  map[string]string
+	}{
+		{input: "app=x", want: map[string]string{"app": "x"}},
+		{input: "app=x,team=a", want: map[string]string{"app": "x", "team": "a"}},
+		{input: "team=a, tier=web ", want: map[string]string{"team": "a", "tier": "web"}},
+		{input: "query=a=b", want: map[string]string{"query": "a=b"}},
+		{input: "empty=", want: map[string]string{"empty": ""}},
+		{input: "novalue,=x,", want: map[string]string{}},
+		{input: "", want: map[string]string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			if got := KeyValues(tt.input); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("KeyValues() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package deferredQueue
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	c "github.com/clubanderson/labeler/pkg/common"
+)
+
+// QueueStruct holds label and annotation operations that could not be applied yet, keyed by context and collection
+type QueueStruct struct {
+	Contexts map[string]map[string][]c.PendingStruct `json:"contexts"`
+}
+
+func queuePath(homeDir string) string {
+	return filepath.Join(c.StateDir(homeDir), "pending.json")
+}
+
+// Load reads the pending queue from the user's home directory. A missing file is an empty queue.
+func Load(homeDir string) (QueueStruct, error) {
+	q := QueueStruct{Contexts: map[string]map[string][]c.PendingStruct{}}
+	data, err := os.ReadFile(queuePath(homeDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return q, nil
+		}
+		return q, err
+	}
+	if err := json.Unmarshal(data, &q); err != nil {
+		return q, err
+	}
+	if q.Contexts == nil {
+		q.Contexts = map[string]map[string][]c.PendingStruct{}
+	}
+	return q, nil
+}
+
+// Save writes the pending queue to the user's home directory, removing empty contexts and collections
+func (q QueueStruct) Save(homeDir string) error {
+	for context, collections := range q.Contexts {
+		for collection, ops := range collections {
+			if len(ops) == 0 {
+				delete(collections, collection)
+			}
+		}
+		if len(collections) == 0 {
+			delete(q.Contexts, context)
+		}
+	}
+	if err := os.MkdirAll(c.StateDir(homeDir), 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(q, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(queuePath(homeDir), data, 0600)
+}
+
+// Add merges operations into the queue. Labels and annotations for an object that is already queued are combined.
+func (q QueueStruct) Add(context, collection string, ops []c.PendingStruct) {
+	if q.Contexts[context] == nil {
+		q.Contexts[context] = map[string][]c.PendingStruct{}
+	}
+	queued := q.Contexts[context][collection]
+	for _, op := range ops {
+		merged := false
+		for i := range queued {
+			if queued[i].Resource == op.Resource {
+				queued[i].Labels = mergeMaps(queued[i].Labels, op.Labels)
+				queued[i].Annotations = mergeMaps(queued[i].Annotations, op.Annotations)
+				merged = true
+				break
+			}
+		}
+		if !merged {
+			queued = append(queued, op)
+		}
+	}
+	q.Contexts[context][collection] = queued
+}
+
+func mergeMaps(dst, src map[string]string) map[string]string {
+	if dst == nil {
+		dst = map[string]string{}
+	}
+	for k, v := range src {
+		dst[k] = v
+	}
+	return dst
+}
@@ -0,0 +1,114 @@
+package helpers
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	c "github.com/clubanderson/labeler/pkg/common"
+)
+
+// clusterTargetStruct is the cluster a run talks to, empty fields are left to the kubeconfig
+type clusterTargetStruct struct {
+	Kubeconfig string
+	Context    string
+	Server     string
+}
+
+// resolveClusterTarget derives the cluster of a run from the kubectl or helm command labeler wraps (in piped mode the
+// command that produced the input, for retry and undo the labeler command itself) and from labeler's own flags
+// (--kubeconfig, --context, --server). When both name a kubeconfig, context or server they have to agree, otherwise
+// labeler would label the objects in another cluster than the one the command changed.
+func resolveClusterTarget(p c.ParamsStruct) (clusterTargetStruct, error) {
+	args := strings.Fields(p.OriginalCmd)
+	if len(args) == 0 && len(os.Args) > 1 {
+		args = os.Args[1:]
+	}
+
+	var command clusterTargetStruct
+	command.Kubeconfig = lastValue(flagValues(args, "--kubeconfig"))
+	if len(args) > 0 && (filepath.Base(args[0]) == "helm" || args[0] == "h") {
+		// helm reads the context and API server from its environment too
+		command.Context = firstNonEmpty(lastValue(flagValues(args, "--kube-context")), os.Getenv("HELM_KUBECONTEXT"))
+		command.Server = firstNonEmpty(lastValue(flagValues(args, "--kube-apiserver")), os.Getenv("HELM_KUBEAPISERVER"))
+	} else {
+		command.Context = lastValue(flagValues(args, "--context"))
+		command.Server = lastValue(flagValues(args, "--server", "-s"))
+	}
+
+	var target clusterTargetStruct
+	var err error
+	if target.Kubeconfig, err = agree("kubeconfig", command.Kubeconfig, c.Flags.Kubeconfig); err != nil {
+		return target, err
+	}
+	// a command without --kubeconfig used the KUBECONFIG of the environment, which can be a list of files
+	if command.Kubeconfig == "" && p.OriginalCmd != "" {
+		if _, err = agree("kubeconfig", os.Getenv("KUBECONFIG"), c.Flags.Kubeconfig); err != nil {
+			return target, err
+		}
+	}
+	if target.Context, err = agree("context", command.Context, c.Flags.Context); err != nil {
+		return target, err
+	}
+	if target.Server, err = agree("server", command.Server, c.Flags.Server); err != nil {
+		return target, err
+	}
+	return target, nil
+}
+
+// agree returns the value the command or labeler was given, and an error if they were given different values (paths
+// are compared cleaned)
+func agree(flag, command, labeler string) (string, error) {
+	if command != "" && labeler != "" && filepath.Clean(command) != filepath.Clean(labeler) {
+		return "", fmt.Errorf("the command uses %v %q but labeler was given %q, the objects would be labeled in another cluster than the one the command changed", flag, command, labeler)
+	}
+	return firstNonEmpty(command, labeler), nil
+}
+
+func lastValue(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[len(values)-1]
+}
+
+// clusterArgs returns the flags that point a kubectl or helm command labeler runs itself at the cluster of the run
+func clusterArgs(helm bool, p c.ParamsStruct) []string {
+	target, err := resolveClusterTarget(p)
+	if err != nil {
+		return nil
+	}
+	var args []string
+	if target.Kubeconfig != "" {
+		args = append(args, "--kubeconfig", target.Kubeconfig)
+	}
+	if helm {
+		if target.Context != "" {
+			args = append(args, "--kube-context", target.Context)
+		}
+		if target.Server != "" {
+			args = append(args, "--kube-apiserver", target.Server)
+		}
+	} else {
+		if target.Context != "" {
+			args = append(args, "--context", target.Context)
+		}
+		if target.Server != "" {
+			args = append(args, "--server", target.Server)
+		}
+	}
+	return args
+}
+
+// withClusterArgs appends the clusterArgs of the run to the args of a helm command, leaving out the flags the args
+// already hold so that each of them is given once
+func withClusterArgs(args []string, p c.ParamsStruct) []string {
+	extra := clusterArgs(true, p)
+	for i := 0; i+1 < len(extra); i += 2 {
+		if len(flagValues(args, extra[i])) == 0 {
+			args = append(args, extra[i], extra[i+1])
+		}
+	}
+	return args
+}
@@ -0,0 +1,192 @@
+package helpers
+
+import (
+	"reflect"
+	"testing"
+
+	c "github.com/clubanderson/labeler/pkg/common"
+)
+
+func TestAgree(t *testing.T) {
+	tests := []struct {
+		name    string
+		command string
+		labeler string
+		want    string
+		wantErr bool
+	}{
+		{name: "neither", want: ""},
+		{name: "command only", command: "prod", want: "prod"},
+		{name: "labeler only", labeler: "prod", want: "prod"},
+		{name: "same", command: "prod", labeler: "prod", want: "prod"},
+		{name: "same path cleaned", command: "/home/me/.kube/../.kube/config", labeler: "/home/me/.kube/config", want: "/home/me/.kube/../.kube/config"},
+		{name: "different", command: "prod", labeler: "dev", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := agree("context", tt.command, tt.labeler)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("agree() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("agree() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveClusterTarget(t *testing.T) {
+	tests := []struct {
+		name       string
+		command    string
+		env        map[string]string
+		kubeconfig string
+		context    string
+		server     string
+		want       clusterTargetStruct
+		wantErr    bool
+	}{
+		{
+			name:    "kubectl flags",
+			command: "kubectl apply -f app.yaml --context=prod --server https://prod:6443 --kubeconfig /tmp/prod",
+			want:    clusterTargetStruct{Kubeconfig: "/tmp/prod", Context: "prod", Server: "https://prod:6443"},
+		},
+		{
+			name:    "kubectl short server flag",
+			command: "kubectl apply -f app.yaml -s https://prod:6443",
+			want:    clusterTargetStruct{Server: "https://prod:6443"},
+		},
+		{
+			name:    "helm flags",
+			command: "helm upgrade app ./chart --kube-context prod --kube-apiserver=https://prod:6443",
+			want:    clusterTargetStruct{Context: "prod", Server: "https://prod:6443"},
+		},
+		{
+			name:    "helm alias reads the environment",
+			command: "h install app ./chart",
+			env:     map[string]string{"HELM_KUBECONTEXT": "prod", "HELM_KUBEAPISERVER": "https://prod:6443"},
+			want:    clusterTargetStruct{Context: "prod", Server: "https://prod:6443"},
+		},
+		{
+			name:    "helm flag wins over the environment",
+			command: "helm install app ./chart --kube-context dev",
+			env:     map[string]string{"HELM_KUBECONTEXT": "prod"},
+			want:    clusterTargetStruct{Context: "dev"},
+		},
+		{
+			name:    "kubectl ignores the helm environment",
+			command: "kubectl apply -f app.yaml",
+			env:     map[string]string{"HELM_KUBECONTEXT": "prod"},
+			want:    clusterTargetStruct{},
+		},
+		{
+			name:    "labeler flags fill in",
+			command: "kubectl apply -f app.yaml",
+			context: "prod",
+			server:  "https://prod:6443",
+			want:    clusterTargetStruct{Context: "prod", Server: "https://prod:6443"},
+		},
+		{
+			name:    "context conflict",
+			command: "kubectl apply -f app.yaml --context dev",
+			context: "prod",
+			wantErr: true,
+		},
+		{
+			name:    "helm environment conflict",
+			command: "helm install app ./chart",
+			env:     map[string]string{"HELM_KUBECONTEXT": "dev"},
+			context: "prod",
+			wantErr: true,
+		},
+		{
+			name:    "server conflict",
+			command: "kubectl apply -f app.yaml --server=https://dev:6443",
+			server:  "https://prod:6443",
+			wantErr: true,
+		},
+		{
+			name:       "kubeconfig conflict",
+			command:    "kubectl apply -f app.yaml --kubeconfig /tmp/dev",
+			kubeconfig: "/tmp/prod",
+			wantErr:    true,
+		},
+		{
+			name:       "command used the KUBECONFIG of the environment",
+			command:    "kubectl apply -f app.yaml",
+			env:        map[string]string{"KUBECONFIG": "/tmp/dev"},
+			kubeconfig: "/tmp/prod",
+			wantErr:    true,
+		},
+		{
+			name:       "KUBECONFIG of the environment agrees",
+			command:    "kubectl apply -f app.yaml",
+			env:        map[string]string{"KUBECONFIG": "/tmp/prod"},
+			kubeconfig: "/tmp/prod",
+			want:       clusterTargetStruct{Kubeconfig: "/tmp/prod"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range []string{"KUBECONFIG", "HELM_KUBECONTEXT", "HELM_KUBEAPISERVER"} {
+				t.Setenv(name, tt.env[name])
+			}
+			saved := c.Flags
+			defer func() { c.Flags = saved }()
+			c.Flags.Kubeconfig, c.Flags.Context, c.Flags.Server = tt.kubeconfig, tt.context, tt.server
+
+			got, err := resolveClusterTarget(c.ParamsStruct{OriginalCmd: tt.command})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("resolveClusterTarget() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && got != tt.want {
+				t.Errorf("resolveClusterTarget() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithClusterArgs(t *testing.T) {
+	tests := []struct {
+		name    string
+		command string
+		args    []string
+		context string
+		want    []string
+	}{
+		{
+			name:    "flags of the command are not repeated",
+			command: "helm upgrade app ./chart --kube-context prod --kubeconfig /tmp/prod",
+			args:    []string{"template", "app", "./chart", "--kube-context", "prod", "--kubeconfig", "/tmp/prod"},
+			want:    []string{"template", "app", "./chart", "--kube-context", "prod", "--kubeconfig", "/tmp/prod"},
+		},
+		{
+			name:    "labeler flags are added",
+			command: "helm upgrade app ./chart",
+			args:    []string{"template", "app", "./chart"},
+			context: "prod",
+			want:    []string{"template", "app", "./chart", "--kube-context", "prod"},
+		},
+		{
+			name:    "flags given with =",
+			command: "helm upgrade app ./chart --kube-context=prod",
+			args:    []string{"get", "manifest", "app", "--kube-context=prod"},
+			want:    []string{"get", "manifest", "app", "--kube-context=prod"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range []string{"KUBECONFIG", "HELM_KUBECONTEXT", "HELM_KUBEAPISERVER"} {
+				t.Setenv(name, "")
+			}
+			saved := c.Flags
+			defer func() { c.Flags = saved }()
+			c.Flags.Kubeconfig, c.Flags.Context, c.Flags.Server = "", tt.context, ""
+
+			got := withClusterArgs(tt.args, c.ParamsStruct{OriginalCmd: tt.command})
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("withClusterArgs() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
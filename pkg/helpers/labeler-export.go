@@ -0,0 +1,48 @@
+package helpers
+
+import (
+	"fmt"
+	"log"
+
+	c "github.com/clubanderson/labeler/pkg/common"
+	k "github.com/clubanderson/labeler/pkg/kube-helpers"
+	pendingExport "github.com/clubanderson/labeler/pkg/pending-export"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// exportPending writes the operations deferred or skipped during this run to --l-export-pending
+func exportPending(p c.ParamsStruct) {
+	path, format := p.Params["l-export-pending"], p.Params["l-export-format"]
+	if path == "" {
+		path, format = c.Flags.ExportPath, c.Flags.ExportFormat
+	}
+	if path == "" {
+		return
+	}
+	ops := append(append([]c.PendingStruct{}, c.RunResults.Pending...), c.RunResults.Skipped...)
+	if len(ops) == 0 {
+		log.Println("labeler.go: no pending operations to export")
+		return
+	}
+
+	// the kinds of the objects the run saw, the cluster is only asked for others
+	kindFor := func(gvr schema.GroupVersionResource) (schema.GroupVersionKind, error) {
+		if kind, ok := c.RunResults.Kinds[gvr]; ok {
+			return gvr.GroupVersion().WithKind(kind), nil
+		}
+		if p.RestConfig == nil {
+			return schema.GroupVersionKind{}, fmt.Errorf("no cluster connection")
+		}
+		mapper, err := k.RESTMapper(p)
+		if err != nil {
+			return schema.GroupVersionKind{}, err
+		}
+		return mapper.KindFor(gvr)
+	}
+	if err := pendingExport.Write(path, format, ops, kindFor); err != nil {
+		log.Println("labeler.go: error (exporting pending operations):", err)
+		return
+	}
+	log.Printf("labeler.go: %d pending operations exported to %q\n", len(ops), path)
+}
@@ -0,0 +1,248 @@
+package helpers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	c "github.com/clubanderson/labeler/pkg/common"
+	"gopkg.in/yaml.v3"
+)
+
+// helmReleaseStruct identifies the release revision a helm install, upgrade or rollback produced
+type helmReleaseStruct struct {
+	Name      string `yaml:"name"`
+	Namespace string `yaml:"namespace"`
+	Revision  int    `yaml:"version"`
+}
+
+// helmValueFlags are the helm flags that take a separate value, used to find the positional args of a command
+var helmValueFlags = map[string]bool{
+	"-n": true, "--namespace": true, "--kube-context": true, "--kubeconfig": true, "--kube-apiserver": true,
+	"--kube-as-user": true, "--kube-as-group": true, "--kube-ca-file": true, "--kube-token": true, "--kube-tls-server-name": true,
+	"--registry-config": true, "--repository-cache": true, "--repository-config": true, "--burst-limit": true,
+	"--timeout": true, "--version": true, "-f": true, "--values": true, "--set": true, "--set-string": true,
+	"--set-file": true, "--set-json": true, "--set-literal": true, "--description": true, "--post-renderer": true,
+	"--post-renderer-args": true, "--repo": true, "--username": true, "--password": true, "--ca-file": true,
+	"--cert-file": true, "--key-file": true, "--keyring": true, "--history-max": true, "--max": true, "-o": true,
+	"--output": true, "--name-template": true, "--labels": true,
+}
+
+// helmConnectionFlags are passed on to the helm commands labeler runs itself, so they talk to the same cluster and namespace
+var helmConnectionFlags = []string{"-n", "--namespace", "--kube-context", "--kubeconfig", "--kube-apiserver", "--kube-as-user",
+	"--kube-as-group", "--kube-ca-file", "--kube-token", "--kube-tls-server-name", "--kube-insecure-skip-tls-verify"}
+
+// helmPositionalArgs returns the args of a helm command that are not flags or flag values, e.g. [rollback myrelease 2]
+func helmPositionalArgs(args []string) []string {
+	var positional []string
+	for i := 1; i < len(args); i++ {
+		arg := args[i]
+		if strings.HasPrefix(arg, "-") {
+			if helmValueFlags[arg] {
+				i++
+			}
+			continue
+		}
+		positional = append(positional, arg)
+	}
+	return positional
+}
+
+// helmSubcommand returns the helm subcommand, e.g. install
+func helmSubcommand(args []string) string {
+	positional := helmPositionalArgs(args)
+	if len(positional) == 0 {
+		return ""
+	}
+	return positional[0]
+}
+
+// isHelmDryRun reports whether the helm command did not install anything (--dry-run, --dry-run=client|server)
+func isHelmDryRun(args []string) bool {
+	for _, arg := range args {
+		if arg == "--dry-run" || (strings.HasPrefix(arg, "--dry-run=") && arg != "--dry-run=none" && arg != "--dry-run=false") {
+			return true
+		}
+	}
+	return false
+}
+
+// helmConnectionArgs returns the flags of args that select the cluster, and the namespace unless withNamespace is false
+func helmConnectionArgs(args []string, withNamespace bool) []string {
+	var connection []string
+	for i := 1; i < len(args); i++ {
+		for _, flag := range helmConnectionFlags {
+			if !withNamespace && (flag == "-n" || flag == "--namespace") {
+				continue
+			}
+			if args[i] == flag && helmValueFlags[flag] && i+1 < len(args) {
+				connection = append(connection, args[i], args[i+1])
+			} else if args[i] == flag || strings.HasPrefix(args[i], flag+"=") {
+				connection = append(connection, args[i])
+			}
+		}
+	}
+	return connection
+}
+
+// parseHelmRelease finds the release name, namespace and revision in the output of helm install, upgrade or
+// rollback. The default table output and -o json|yaml are supported.
+func parseHelmRelease(output []byte) helmReleaseStruct {
+	var release helmReleaseStruct
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "NOTES:" {
+			break
+		}
+		key, val, found := strings.Cut(line, ": ")
+		if !found {
+			continue
+		}
+		switch key {
+		case "NAME":
+			release.Name = strings.TrimSpace(val)
+		case "NAMESPACE":
+			release.Namespace = strings.TrimSpace(val)
+		case "REVISION":
+			release.Revision, _ = strconv.Atoi(strings.TrimSpace(val))
+		}
+	}
+	if release.Name == "" {
+		_ = yaml.Unmarshal(skipToRelease(output), &release)
+	}
+	return release
+}
+
+// skipToRelease drops any warnings helm printed before its -o json|yaml output. The keys of the YAML output are
+// sorted, it starts with the chart (which has name: keys of its own).
+func skipToRelease(output []byte) []byte {
+	offset := 0
+	for _, line := range bytes.SplitAfter(output, []byte("\n")) {
+		if bytes.HasPrefix(line, []byte("{")) || bytes.HasPrefix(line, []byte("chart:")) || bytes.HasPrefix(line, []byte("name:")) {
+			return output[offset:]
+		}
+		offset += len(line)
+	}
+	return output
+}
+
+// isHelmRelease reports whether lines are the release helm install, upgrade or rollback printed with -o json|yaml,
+// which holds the objects as its manifest rather than being the objects
+func isHelmRelease(lines []string) bool {
+	for _, line := range lines {
+		if isJSON(line) {
+			var release map[string]interface{}
+			if json.Unmarshal([]byte(line), &release) != nil {
+				return false
+			}
+			_, manifest := release["manifest"]
+			_, info := release["info"]
+			_, kind := release["kind"]
+			return manifest && info && !kind
+		}
+		if line == "chart:" {
+			return true
+		}
+		if isManifestStart(line) {
+			return false
+		}
+	}
+	return false
+}
+
+// producedHelmRelease reports whether the command that produced the input (known with the shell integration)
+// installed, upgraded or rolled back a release
+func producedHelmRelease(p c.ParamsStruct) bool {
+	args := strings.Fields(p.OriginalCmd)
+	if !p.Flags["helm"] || isHelmDryRun(args) {
+		return false
+	}
+	switch helmSubcommand(args) {
+	case "install", "upgrade", "rollback":
+		return true
+	}
+	return false
+}
+
+// releaseManifest returns the manifest helm recorded for the release revision that args installed, upgraded or
+// rolled back to. Unlike re-rendering the chart with helm template, it holds exactly the objects helm applied.
+func releaseManifest(args []string, output []byte, p c.ParamsStruct) ([]byte, error) {
+	release := parseHelmRelease(output)
+	if release.Name == "" {
+		// helm rollback <release> [revision] only prints a success message
+		positional := helmPositionalArgs(args)
+		if len(positional) < 2 {
+			return nil, fmt.Errorf("could not find the release name in %q", strings.Join(args, " "))
+		}
+		release.Name = positional[1]
+	}
+
+	getArgs := []string{"get", "manifest", release.Name}
+	getArgs = append(getArgs, helmConnectionArgs(args, release.Namespace == "")...)
+	if release.Namespace != "" {
+		getArgs = append(getArgs, "--namespace", release.Namespace)
+	}
+	getArgs = withClusterArgs(getArgs, p)
+	if release.Revision > 0 {
+		getArgs = append(getArgs, "--revision", strconv.Itoa(release.Revision))
+	}
+	if p.Flags["l-debug"] {
+		log.Printf("labeler.go: [debug] helm %v\n", strings.Join(getArgs, " "))
+	}
+	return p.RunCmd("helm", getArgs, true)
+}
+
+// helmManifests returns the objects a helm command produced: the release manifest after install, upgrade and
+// rollback, or the rendered chart for dry runs and other commands
+func helmManifests(args []string, output []byte, p c.ParamsStruct) ([]byte, error) {
+	switch helmSubcommand(args) {
+	case "install", "upgrade":
+		if !isHelmDryRun(args) {
+			return releaseManifest(args, output, p)
+		}
+	case "rollback":
+		if isHelmDryRun(args) {
+			// nothing was rolled back, and there is no chart to render
+			return nil, nil
+		}
+		return releaseManifest(args, output, p)
+	}
+	return runHelmInTemplateMode(args, p), nil
+}
+
+// postRendererArgs returns the helm flags that register 'labeler post-render' as the post-renderer of an install or
+// upgrade, so that helm creates the objects with the labels and annotations already in place
+func postRendererArgs(args []string, p c.ParamsStruct) ([]string, error) {
+	for _, arg := range args {
+		if arg == "--post-renderer" || strings.HasPrefix(arg, "--post-renderer=") {
+			return nil, fmt.Errorf("helm accepts a single --post-renderer and one is already given")
+		}
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	renderArgs := []string{"post-render"}
+	if p.Params["labelKey"] != "" {
+		renderArgs = append(renderArgs, "--label="+p.Params["labelKey"]+"="+p.Params["labelVal"])
+	}
+	if p.Params["l-annotation"] != "" {
+		renderArgs = append(renderArgs, "--l-annotation="+p.Params["l-annotation"])
+	}
+	if p.Flags["l-pod-template"] {
+		renderArgs = append(renderArgs, "--l-pod-template")
+	}
+
+	postRenderer := []string{"--post-renderer", self}
+	for _, arg := range renderArgs {
+		postRenderer = append(postRenderer, "--post-renderer-args", arg)
+	}
+	return postRenderer, nil
+}
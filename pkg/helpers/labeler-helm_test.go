@@ -0,0 +1,143 @@
+package helpers
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	c "github.com/clubanderson/labeler/pkg/common"
+)
+
+const releaseJSON = `{"name":"sealed-secrets","info":{"status":"deployed"},"chart":{"metadata":{"name":"sealed-secrets"}},"manifest":"---\n# Source: sealed-secrets/templates/service.yaml\napiVersion: v1\nkind: Service\nmetadata:\n  name: sealed-secrets\n","version":3,"namespace":"kube-system"}`
+
+const releaseYAML = `chart:
+  files:
+  - data: e30=
+    name: values.schema.json
+  metadata:
+    name: sealed-secrets
+info:
+  status: deployed
+manifest: |
+  ---
+  # Source: sealed-secrets/templates/service.yaml
+  apiVersion: v1
+  kind: Service
+  metadata:
+    name: sealed-secrets
+name: sealed-secrets
+namespace: kube-system
+version: 3`
+
+func TestIsHelmRelease(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  bool
+	}{
+		{name: "release json", input: releaseJSON, want: true},
+		{name: "release json after a warning", input: "WARNING: Kubernetes configuration file is group-readable\n" + releaseJSON, want: true},
+		{name: "release yaml", input: releaseYAML, want: true},
+		{name: "object json", input: `{"apiVersion":"v1","kind":"Service","metadata":{"name":"sealed-secrets"}}`, want: false},
+		{name: "list json", input: `{"apiVersion":"v1","kind":"List","items":[]}`, want: false},
+		{name: "manifests", input: "---\napiVersion: v1\nkind: Service\nmetadata:\n  name: sealed-secrets", want: false},
+		{name: "table output", input: "NAME: sealed-secrets\nLAST DEPLOYED: Mon Oct 19 10:00:00 2026\nNAMESPACE: kube-system\nSTATUS: deployed\nREVISION: 3", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isHelmRelease(strings.Split(tt.input, "\n")); got != tt.want {
+				t.Errorf("isHelmRelease() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProducedHelmRelease(t *testing.T) {
+	tests := []struct {
+		command string
+		helm    bool
+		want    bool
+	}{
+		{command: "helm install sealed-secrets sealed-secrets/sealed-secrets -o json", helm: true, want: true},
+		{command: "helm upgrade --install sealed-secrets sealed-secrets/sealed-secrets -n kube-system -o yaml", helm: true, want: true},
+		{command: "helm rollback sealed-secrets 2", helm: true, want: true},
+		{command: "helm install sealed-secrets sealed-secrets/sealed-secrets --dry-run", helm: true, want: false},
+		{command: "helm template sealed-secrets sealed-secrets/sealed-secrets", helm: true, want: false},
+		{command: "kubectl apply -f app.yaml -o yaml", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.command, func(t *testing.T) {
+			p := c.ParamsStruct{Flags: map[string]bool{"helm": tt.helm}, OriginalCmd: tt.command}
+			if got := producedHelmRelease(p); got != tt.want {
+				t.Errorf("producedHelmRelease() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHelmPositionalArgs(t *testing.T) {
+	tests := []struct {
+		command string
+		want    []string
+	}{
+		{command: "helm install sealed-secrets sealed-secrets/sealed-secrets", want: []string{"install", "sealed-secrets", "sealed-secrets/sealed-secrets"}},
+		{command: "helm -n kube-system upgrade --install sealed-secrets ./chart --set a=b -f values.yaml --wait", want: []string{"upgrade", "sealed-secrets", "./chart"}},
+		{command: "helm rollback sealed-secrets 2 --kube-context=prod", want: []string{"rollback", "sealed-secrets", "2"}},
+		{command: "helm --kubeconfig /tmp/prod", want: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.command, func(t *testing.T) {
+			if got := helmPositionalArgs(strings.Fields(tt.command)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("helmPositionalArgs() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHelmTemplateArgs(t *testing.T) {
+	tests := []struct {
+		command string
+		want    []string
+	}{
+		{command: "helm install app ./chart -n apps", want: []string{"template", "app", "./chart", "-n", "apps"}},
+		{command: "helm upgrade --install app ./chart", want: []string{"template", "app", "./chart"}},
+		{command: "helm upgrade -i app ./chart --set install=true", want: []string{"template", "app", "./chart", "--set", "install=true"}},
+		{command: "helm upgrade install ./chart", want: []string{"template", "install", "./chart"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.command, func(t *testing.T) {
+			if got := helmTemplateArgs(strings.Fields(tt.command)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("helmTemplateArgs() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseHelmRelease(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   helmReleaseStruct
+	}{
+		{
+			name:   "table",
+			output: "Release \"sealed-secrets\" has been upgraded. Happy Helming!\nNAME: sealed-secrets\nLAST DEPLOYED: Mon Oct 19 10:00:00 2026\nNAMESPACE: kube-system\nSTATUS: deployed\nREVISION: 3\nNOTES:\nNAME: not-the-release",
+			want:   helmReleaseStruct{Name: "sealed-secrets", Namespace: "kube-system", Revision: 3},
+		},
+		{name: "json", output: releaseJSON, want: helmReleaseStruct{Name: "sealed-secrets", Namespace: "kube-system", Revision: 3}},
+		{
+			name:   "json after a warning",
+			output: "WARNING: Kubernetes configuration file is group-readable\n" + releaseJSON,
+			want:   helmReleaseStruct{Name: "sealed-secrets", Namespace: "kube-system", Revision: 3},
+		},
+		{name: "yaml with the chart first", output: releaseYAML, want: helmReleaseStruct{Name: "sealed-secrets", Namespace: "kube-system", Revision: 3}},
+		{name: "rollback", output: "Rollback was a success! Happy Helming!", want: helmReleaseStruct{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseHelmRelease([]byte(tt.output)); got != tt.want {
+				t.Errorf("parseHelmRelease() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
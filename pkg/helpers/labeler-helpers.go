@@ -1,7 +1,6 @@
 package helpers
 
 import (
-	"bufio"
 	"bytes"
 	"fmt"
 	"io"
@@ -10,8 +9,8 @@ import (
 	"path/filepath"
 	"plugin"
 	"reflect"
-	"regexp"
 	"runtime"
+	"slices"
 	"strings"
 
 	c "github.com/clubanderson/labeler/pkg/common"
@@ -28,15 +27,12 @@ import (
 
 	"github.com/pkg/errors"
 	"gopkg.in/yaml.v3"
+	"k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime/schema"
-	k8sYAML "k8s.io/apimachinery/pkg/util/yaml"
-	"k8s.io/client-go/discovery"
-	"k8s.io/client-go/discovery/cached/disk"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
-	"k8s.io/client-go/restmapper"
 	"k8s.io/client-go/tools/clientcmd"
 )
 
@@ -55,6 +51,17 @@ var pluginFunctions = []interface{}{
 	// add other plugin functions here as needed
 }
 
+// bufferedPlugins work on all objects of the input at once (a ManifestWork holds all of them) or must only run once.
+// When labeler streams its input, the other plugins get the objects one by one as they are decoded, these plugins
+// run after the input has been read, with all of its objects in p.Resources. Runtime plugins add theirs with a
+// PluginBuffered symbol that returns their names.
+var bufferedPlugins = map[string]bool{
+	"PluginHelp":           true,
+	"PluginCreateBP":       true,
+	"PluginCreateMW":       true,
+	"PluginRemoteDeployTo": true,
+}
+
 func AliasRun(args []string, p c.ParamsStruct) error {
 	// args = os.Args[1:]
 	p.Flags = make(map[string]bool)
@@ -65,69 +72,7 @@ func AliasRun(args []string, p c.ParamsStruct) error {
 
 	getPluginNamesAndArgs(p)
 
-	p.Flags[args[0]] = true
-	for i, arg := range args {
-		if strings.HasPrefix(arg, "--") || strings.HasPrefix(arg, "-") {
-			if i < len(args)-1 && !strings.HasPrefix(args[i+1], "-") {
-				if strings.Contains(arg, "=") {
-					parts := strings.Split(arg, "=")
-					p.Params[parts[0][2:]] = parts[1]
-				} else {
-					p.Params[arg[1:]] = args[i+1]
-				}
-			} else if strings.Contains(arg, "=") {
-				parts := strings.Split(arg, "=")
-				var result string
-				if len(parts) > 2 {
-					// log.Printf("labeler.go: arg: %v\n", arg)
-					// log.Printf("labeler.go: len parts: %v\n", len(parts))
-					for i := 1; i < len(parts); i++ {
-						result += parts[i]
-						if i < len(parts)-1 {
-							result += "="
-						}
-					}
-					// log.Printf("labeler.go: result: %v\n", result)
-					p.Params[parts[0][2:]] = result
-				} else {
-					p.Params[parts[0][2:]] = parts[1]
-				}
-			} else {
-				if strings.HasPrefix(arg, "--") {
-					p.Flags[arg[2:]] = true
-				} else {
-					p.Flags[arg[1:]] = true
-				}
-			}
-		} else if strings.HasPrefix(arg, "install") ||
-			strings.HasPrefix(arg, "upgrade") ||
-			strings.HasPrefix(arg, "template") ||
-			strings.HasPrefix(arg, "apply") ||
-			strings.HasPrefix(arg, "create") ||
-			strings.HasPrefix(arg, "delete") ||
-			strings.HasPrefix(arg, "get") ||
-			strings.HasPrefix(arg, "describe") ||
-			strings.HasPrefix(arg, "edit") ||
-			strings.HasPrefix(arg, "exec") ||
-			strings.HasPrefix(arg, "logs") ||
-			strings.HasPrefix(arg, "port-forward") ||
-			strings.HasPrefix(arg, "replace") ||
-			strings.HasPrefix(arg, "rollout") ||
-			strings.HasPrefix(arg, "scale") ||
-			strings.HasPrefix(arg, "set") ||
-			strings.HasPrefix(arg, "top") ||
-			strings.HasPrefix(arg, "expose") ||
-			strings.HasPrefix(arg, "autoscale") ||
-			strings.HasPrefix(arg, "attach") ||
-			strings.HasPrefix(arg, "wait") ||
-			strings.HasPrefix(arg, "cp") ||
-			strings.HasPrefix(arg, "run") ||
-			strings.HasPrefix(arg, "label") ||
-			strings.HasPrefix(arg, "annotate") ||
-			strings.HasPrefix(arg, "patch") {
-			p.Flags[arg] = true
-		}
-	}
+	parseArgs(args, p)
 
 	// Print flags and params
 	if p.Flags["l-debug"] {
@@ -143,7 +88,7 @@ func AliasRun(args []string, p c.ParamsStruct) error {
 		log.Println()
 	}
 
-	k.AddNamespaceToResources(p)
+	addNamespaceToResources(p)
 
 	if args[0] == "k" || args[0] == "kubectl" || args[0] == "helm" {
 
@@ -196,8 +141,27 @@ func AliasRun(args []string, p c.ParamsStruct) error {
 			originalCommand := strings.Join(args, " ")
 			p.OriginalCmd = originalCommand
 
+			// with -f - the manifests are piped to kubectl, keep a copy of them while kubectl reads them
+			var stdinManifests bytes.Buffer
+			var stdin io.Reader = os.Stdin
+			readsStdin, readsOther := kubectlInputs(args[1:])
+			if p.Flags["l-pre-apply"] && kubectlWritesObjects(args, p) {
+				// kubectl creates the objects labeled, the labeling below then only verifies them
+				preApplyArgs, manifests, err := injectBeforeApply(args, p)
+				if err != nil {
+					log.Println("labeler.go: error (pre-apply):", err)
+					return err
+				}
+				args = preApplyArgs
+				stdinManifests.Write(manifests)
+				stdin = bytes.NewReader(manifests)
+				readsStdin, readsOther = true, false
+			} else if readsStdin {
+				stdin = io.TeeReader(os.Stdin, &stdinManifests)
+			}
+
 			// cmd := exec.Command(args[0], args[1:]...)
-			out, err := p.RunCmd(args[0], args[1:], false)
+			out, err := p.RunCmdWithStdin(args[0], args[1:], false, stdin)
 			// out, err := cmd.CombinedOutput()
 			if err != nil {
 				// fmt.Printf("%v", string(out))
@@ -206,24 +170,56 @@ func AliasRun(args []string, p c.ParamsStruct) error {
 
 			p.ClientSet, p.RestConfig, p.DynamicClient = SwitchContext(p)
 
-			output := strings.TrimSpace(string(out))
-			lines := strings.Split(output, "\n")
+			if stdinManifests.Len() > 0 && kubectlWritesObjects(args, p) {
+				// the manifests give the exact kinds and namespaces of the objects
+				err = traverseHelmOutput(&stdinManifests, p)
+				if err != nil {
+					log.Println("labeler.go: error (to traverseInput):", err)
+					return err
+				}
+			}
+			if dirs := kustomizeDirs(args[1:]); len(dirs) > 0 && kubectlWritesObjects(args, p) {
+				err = traverseKustomizations(dirs, p)
+				if err != nil {
+					log.Println("labeler.go: error (kustomize):", err)
+					return err
+				}
+			} else if readsOther || !readsStdin {
+				output := strings.TrimSpace(string(out))
+				lines := strings.Split(output, "\n")
 
-			traverseKubectlOutput(lines, p)
+				traverseKubectlOutput(lines, p)
+			}
 
 		} else if args[0] == "helm" {
+			p.OriginalCmd = strings.Join(args, " ")
+
+			// have helm create the objects labeled, the labeling below then only verifies them
+			if p.Flags["l-post-render"] && (helmSubcommand(args) == "install" || helmSubcommand(args) == "upgrade") {
+				postRenderer, err := postRendererArgs(args, p)
+				if err != nil {
+					log.Println("labeler.go: error (post-renderer):", err)
+					return err
+				}
+				args = append(args, postRenderer...)
+			}
+
 			// run the original helm command without the extra labeler flags
-			_, err := p.RunCmd("helm", args[1:], false)
+			out, err := p.RunCmd("helm", args[1:], false)
 			if err != nil {
 				os.Exit(1)
 			}
 
-			// now run helm as template and collect output
-			templateOutput := runHelmInTemplateMode(args, p)
+			// now collect the objects of the release helm installed (or the rendered chart for a dry run)
+			manifests, err := helmManifests(args, out, p)
+			if err != nil {
+				log.Println("labeler.go: error (helm get manifest):", err)
+				return err
+			}
 
 			// set the context and get the helm output into the resources map
 			p.ClientSet, p.RestConfig, p.DynamicClient = SwitchContext(p)
-			err = traverseHelmOutput(strings.NewReader(string(templateOutput)), p)
+			err = traverseHelmOutput(bytes.NewReader(manifests), p)
 			if err != nil {
 				log.Println("labeler.go: error (to traverseInput):", err)
 				return err
@@ -231,116 +227,203 @@ func AliasRun(args []string, p c.ParamsStruct) error {
 
 		}
 
-		combinedFlagsAndParams := make(map[string]bool)
-		for key, value := range p.Flags {
-			combinedFlagsAndParams[key] = value
-		}
-		for key := range p.Params {
-			combinedFlagsAndParams[key] = true
-		}
+		runPlugins(p)
+		c.RunResults.PrintSummary()
+		savePending(p)
+		exportPending(p)
+		saveJournal(p)
+
 		if p.Flags["l-debug"] {
-			for key, value := range p.PluginPtrs {
-				log.Printf("labeler.go: key: %v, value: %v\n", key, value)
+			for key, value := range p.Resources {
+				fmt.Printf("labeler.go: [debug] resources: Key: %s, Value: \n%s\n", key, value)
 			}
 		}
+	}
+	return nil
+}
+
+// runPlugins calls every plugin that one of the flags or params in p is an argument of, each plugin at most once
+func runPlugins(p c.ParamsStruct) {
+	p = k.StartWait(p)
+	for _, pkey := range triggeredPlugins(p) {
+		log.Printf("\nlabeler plugin: %q:\n\n", pkey)
+		callPlugin(pkey, p)
+	}
+}
+
+// triggeredPlugins returns the plugins that one of the flags or params in p is an argument of
+func triggeredPlugins(p c.ParamsStruct) []string {
+	combinedFlagsAndParams := make(map[string]bool)
+	for key, value := range p.Flags {
+		combinedFlagsAndParams[key] = value
+	}
+	for key := range p.Params {
+		combinedFlagsAndParams[key] = true
+	}
+	if p.Flags["l-debug"] {
+		for key, value := range p.PluginPtrs {
+			log.Printf("labeler.go: key: %v, value: %v\n", key, value)
+		}
+	}
 
-		fnArgs := []reflect.Value{reflect.ValueOf(p), reflect.ValueOf(false)}
-
-		runOnce := make(map[string]bool)
-		for key := range combinedFlagsAndParams {
-			for pkey, value := range p.PluginArgs {
-				for _, vCSV := range value {
-					v := strings.Split(vCSV, ",")
-					if key == v[0] {
-						if p.PluginPtrs[pkey].IsValid() {
-							if !runOnce[pkey] {
-								log.Printf("\nlabeler plugin: %q:\n\n", pkey)
-								p.PluginPtrs[pkey].Call(fnArgs)
-								runOnce[pkey] = true
-							}
+	var triggered []string
+	runOnce := make(map[string]bool)
+	for key := range combinedFlagsAndParams {
+		for pkey, value := range p.PluginArgs {
+			for _, vCSV := range value {
+				v := strings.Split(vCSV, ",")
+				if key == v[0] {
+					if p.PluginPtrs[pkey].IsValid() {
+						if !runOnce[pkey] {
+							triggered = append(triggered, pkey)
+							runOnce[pkey] = true
 						}
 					}
 				}
 			}
 		}
-		if p.Flags["l-debug"] {
-			for key, value := range p.Resources {
-				fmt.Printf("labeler.go: [debug] resources: Key: %s, Value: \n%s\n", key, value)
+	}
+	return triggered
+}
+
+func callPlugin(pkey string, p c.ParamsStruct) {
+	fnArgs := []reflect.Value{reflect.ValueOf(p), reflect.ValueOf(false)}
+	p.PluginPtrs[pkey].Call(fnArgs)
+}
+
+// parseArgs records the flags, parameters and verbs of a labeler, kubectl or helm command line in p.Flags and p.Params
+func parseArgs(args []string, p c.ParamsStruct) {
+	p.Flags[args[0]] = true
+	for i, arg := range args {
+		if strings.HasPrefix(arg, "--") || strings.HasPrefix(arg, "-") {
+			if i < len(args)-1 && !strings.HasPrefix(args[i+1], "-") {
+				if strings.Contains(arg, "=") {
+					parts := strings.Split(arg, "=")
+					p.Params[parts[0][2:]] = parts[1]
+				} else {
+					p.Params[arg[1:]] = args[i+1]
+				}
+			} else if strings.Contains(arg, "=") {
+				parts := strings.Split(arg, "=")
+				var result string
+				if len(parts) > 2 {
+					// log.Printf("labeler.go: arg: %v\n", arg)
+					// log.Printf("labeler.go: len parts: %v\n", len(parts))
+					for i := 1; i < len(parts); i++ {
+						result += parts[i]
+						if i < len(parts)-1 {
+							result += "="
+						}
+					}
+					// log.Printf("labeler.go: result: %v\n", result)
+					p.Params[parts[0][2:]] = result
+				} else {
+					p.Params[parts[0][2:]] = parts[1]
+				}
+			} else {
+				if strings.HasPrefix(arg, "--") {
+					p.Flags[arg[2:]] = true
+				} else {
+					p.Flags[arg[1:]] = true
+				}
 			}
+		} else if strings.HasPrefix(arg, "install") ||
+			strings.HasPrefix(arg, "upgrade") ||
+			strings.HasPrefix(arg, "rollback") ||
+			strings.HasPrefix(arg, "template") ||
+			strings.HasPrefix(arg, "apply") ||
+			strings.HasPrefix(arg, "create") ||
+			strings.HasPrefix(arg, "delete") ||
+			strings.HasPrefix(arg, "get") ||
+			strings.HasPrefix(arg, "describe") ||
+			strings.HasPrefix(arg, "edit") ||
+			strings.HasPrefix(arg, "exec") ||
+			strings.HasPrefix(arg, "logs") ||
+			strings.HasPrefix(arg, "port-forward") ||
+			strings.HasPrefix(arg, "replace") ||
+			strings.HasPrefix(arg, "rollout") ||
+			strings.HasPrefix(arg, "scale") ||
+			strings.HasPrefix(arg, "set") ||
+			strings.HasPrefix(arg, "top") ||
+			strings.HasPrefix(arg, "expose") ||
+			strings.HasPrefix(arg, "autoscale") ||
+			strings.HasPrefix(arg, "attach") ||
+			strings.HasPrefix(arg, "wait") ||
+			strings.HasPrefix(arg, "cp") ||
+			strings.HasPrefix(arg, "run") ||
+			strings.HasPrefix(arg, "label") ||
+			strings.HasPrefix(arg, "annotate") ||
+			strings.HasPrefix(arg, "patch") {
+			p.Flags[arg] = true
 		}
 	}
-	return nil
 }
 
 func traverseKubectlOutput(input []string, p c.ParamsStruct) {
-	mapper, _ := createCachedDiscoveryClient(*p.RestConfig, p)
-	allLines := strings.Join(input, "\n")
-
-	re := regexp.MustCompile(`([a-zA-Z0-9.-]+\/[a-zA-Z0-9.-]+) ([a-zA-Z0-9.-]+)`)
-	matches := re.FindAllStringSubmatch(allLines, -1)
-
-	namespace := p.Params["namespaceArg"]
+	mapper, err := k.RESTMapper(p)
+	if err != nil {
+		log.Println("labeler.go: error (discovery):", err)
+		return
+	}
 
-	if len(matches) == 0 {
+	objects, unparsed := parseKubectlOutput(input)
+	if p.Flags["l-debug"] && len(unparsed) > 0 {
+		log.Println("labeler.go: [debug] kubectl output lines that are not objects:")
+		for _, line := range unparsed {
+			log.Printf("labeler.go: [debug]   %v\n", line)
+		}
+	}
+	if len(objects) == 0 {
 		if p.Flags["l-debug"] {
 			log.Println("labeler.go: no resources found")
 		}
 		return
 	}
 
-	// iterate over matches and extract group version kind and object name
-	for _, match := range matches {
-		// log.Printf("labeler.go: match: %v\n", match)
-		// the first match group contains the group kind and object name
-		groupKindObjectName := match[1]
-		// split the string to get group version kind and object name
-		parts := strings.Split(groupKindObjectName, "/")
-		gvkParts := strings.Split(parts[0], ".")
-		k := gvkParts[0]
-		g := ""
-		v := ""
-		if len(gvkParts) >= 1 {
-			g = strings.Join(gvkParts[1:], ".")
-		}
-		objectName := parts[1]
-		client, _ := kubernetes.NewForConfig(p.RestConfig)
-		res, _ := discovery.ServerPreferredResources(client.Discovery())
-		for _, resList := range res {
-			for _, r := range resList.APIResources {
-				// fmt.Printf("%q %q %q\n", r.Group, r.Version, r.Kind)
-				if strings.ToLower(r.Group) == strings.ToLower(g) && strings.ToLower(r.Kind) == strings.ToLower(k) {
-					if r.Version == "" {
-						v = "v1"
-					} else {
-						v = r.Version
-					}
-					break
-				}
-			}
+	args := kubectlCommandArgs(p)
+	if !kubectlWritesObjects(args, p) {
+		return
+	}
+	defaultNamespace := commandNamespace(p)
+	namespaces := manifestNamespaces(args, p)
+
+	var crds []string
+	var unmapped []kubectlObjectStruct
+	for _, obj := range objects {
+		if !kubectlVerbs[obj.Verb] && obj.Verb != "" {
+			// the object no longer exists (deleted, pruned)
+			continue
 		}
-		// log.Printf("labeler.go: labelCmd: %v\n", labelCmd)
-		gvk := schema.GroupVersionKind{
-			Group:   g,
-			Version: v,
-			Kind:    k,
+		if obj.Group == "apiextensions.k8s.io" && obj.Kind == "customresourcedefinition" {
+			crds = append(crds, obj.Name)
 		}
-		gvr, err := getGVRFromGVK(mapper, gvk)
+		resource, err := kubectlObjectResource(obj, mapper, namespaces, defaultNamespace)
 		if err != nil {
 			if p.Flags["l-debug"] {
-				log.Printf("labeler.go: error getting gvr from gvk for %v/%v/%v: %v\n", gvk.Group, gvk.Version, gvk.Kind, err)
+				log.Printf("labeler.go: error getting gvr for %v.%v/%v: %v\n", obj.Kind, obj.Group, obj.Name, err)
 			}
+			unmapped = append(unmapped, obj)
+			continue
 		}
+		addObjectsToResourcesAfterKubectlApply(resource, p)
+	}
+	if len(unmapped) == 0 {
+		return
+	}
 
-		resource := c.ResourceStruct{
-			Group:      gvr.Group,
-			Version:    gvr.Version,
-			Resource:   gvr.Resource,
-			Namespace:  namespace,
-			ObjectName: objectName,
-		}
-		if p.Flags["apply"] || p.Flags["create"] || p.Flags["replace"] {
-			addObjectsToResourcesAfterKubectlApply(resource, p)
+	// custom resources applied together with their CRDs are only known to the mapper once the CRDs are established
+	if len(crds) > 0 {
+		k.WaitForCRDs(crds, p)
+		mapper.Reset()
+	}
+	for _, obj := range unmapped {
+		resource, err := kubectlObjectResource(obj, mapper, namespaces, defaultNamespace)
+		if err != nil {
+			failure := fmt.Sprintf("%v.%v/%v: unknown kind, is its CRD installed? (%v)\n", obj.Kind, obj.Group, obj.Name, err)
+			c.RunResults.FailedToLabel = append(c.RunResults.FailedToLabel, failure)
+			continue
 		}
+		addObjectsToResourcesAfterKubectlApply(resource, p)
 	}
 }
 
@@ -380,16 +463,11 @@ func addObjectsToResourcesAfterKubectlApply(r c.ResourceStruct, p c.ParamsStruct
 		delete(metadata, field)
 	}
 
-	// Check if annotations field exists within metadata
-	annotations, ok := metadata["annotations"].(map[string]interface{})
-	if !ok {
-		log.Println("labeler.go: annotations field not found or not a map[string]interface{}")
-		return
-	}
-
-	// Remove the specified annotation
-	for _, field := range annotationsToRemove {
-		delete(annotations, field)
+	// Remove the specified annotations, objects created without annotations (e.g. namespaces) have none
+	if annotations, ok := metadata["annotations"].(map[string]interface{}); ok {
+		for _, field := range annotationsToRemove {
+			delete(annotations, field)
+		}
 	}
 
 	// Marshal the modified object back to YAML
@@ -402,21 +480,18 @@ func addObjectsToResourcesAfterKubectlApply(r c.ResourceStruct, p c.ParamsStruct
 	p.Resources[r] = modifiedYAMLBytes
 }
 
+// runHelmInTemplateMode renders the chart of a helm command with helm template, against the cluster of the run
 func runHelmInTemplateMode(args []string, p c.ParamsStruct) []byte {
-	originalCommand := strings.Join(args, " ")
-	p.OriginalCmd = originalCommand
-
+	p.OriginalCmd = strings.Join(args, " ")
 	if p.Flags["l-debug"] {
-		log.Printf("labeler.go: [debug] original command: %v\n", originalCommand)
+		log.Printf("labeler.go: [debug] original command: %v\n", p.OriginalCmd)
 	}
-	modifiedCommand := strings.Replace(originalCommand, " install ", " template ", 1)
-	modifiedCommand = strings.Replace(modifiedCommand, " upgrade ", " template ", 1)
-	modifiedCommandComponents := strings.Split(modifiedCommand, " ")[1:]
+	templateArgs := withClusterArgs(helmTemplateArgs(args), p)
 	if p.Flags["l-debug"] {
-		log.Printf("labeler.go: [debug] modified command components: %v\n", modifiedCommandComponents)
+		log.Printf("labeler.go: [debug] modified command components: %v\n", templateArgs)
 	}
 
-	output, err := p.RunCmd("helm", modifiedCommandComponents, true)
+	output, err := p.RunCmd("helm", templateArgs, true)
 	if err != nil {
 		// log.Println("labeler.go: error (run helm):", err)
 		os.Exit(1)
@@ -425,73 +500,95 @@ func runHelmInTemplateMode(args []string, p c.ParamsStruct) []byte {
 }
 
 func traverseHelmOutput(r io.Reader, p c.ParamsStruct) error {
-	mapper, _ := createCachedDiscoveryClient(*p.RestConfig, p)
-
-	var linesOfOutput []string
-
-	scanner := bufio.NewScanner(bufio.NewReader(r))
-	for scanner.Scan() {
-		linesOfOutput = append(linesOfOutput, scanner.Text())
+	mapper, err := k.RESTMapper(p)
+	if err != nil {
+		return err
 	}
-	allLines := strings.Join(linesOfOutput, "\n")
 
-	if i := strings.Index(allLines, "---\n"); i != -1 {
-		// slice the concatenated string from the index of "---\n"
-		allLines = allLines[i:]
+	input, err := io.ReadAll(r)
+	if err != nil {
+		return err
 	}
+	defaultNamespace := commandNamespace(p)
 
-	decoder := yaml.NewDecoder(strings.NewReader(allLines))
-	for {
-		var obj map[string]interface{}
-		err := decoder.Decode(&obj)
-		if err != nil {
-			if err.Error() != "EOF" && !strings.Contains(err.Error(), "did not find expected alphabetic or numeric character") {
-				_ = err
-				// log.Printf("labeler.go: decoding error: %v\n%v\n", err, obj)
-			}
-			break // reached end of file or error
-		}
-
-		// convert map to YAML byte representation
-		yamlBytes, err := yaml.Marshal(obj)
-		if err != nil {
-			log.Printf("labeler.go: error marshaling YAML: %v\n", err)
-			continue
-		}
-		runtimeObj, err := decodeYAML(yamlBytes)
-		if err != nil {
-			// log.Printf("labeler.go: error decoding yaml: %v\n", err)
-			continue
+	var crds []string
+	var unmapped []*unstructured.Unstructured
+	err = decodeManifests(bytes.NewReader(skipToManifests(input)), p.Flags["l-debug"], func(runtimeObj *unstructured.Unstructured) {
+		if k.IsCRD(runtimeObj.GroupVersionKind()) {
+			crds = append(crds, runtimeObj.GetName())
 		}
-		gvk := runtimeObj.GroupVersionKind()
-		// log.Printf("labeler.go: G: %v, V: %v, K: %v, Name: %v", gvk.Group, gvk.Version, gvk.Kind, runtimeObj.GetName())
-
-		gvr, err := getGVRFromGVK(mapper, gvk)
-		if err != nil {
+		if err := addManifestObject(runtimeObj, mapper, defaultNamespace, p); err != nil {
 			if p.Flags["l-debug"] {
-				log.Printf("labeler.go: error getting gvr from gvk for %v/%v/%v. Retrying in 5 seconds: %v\n", gvk.Group, gvk.Version, gvk.Kind, err)
+				gvk := runtimeObj.GroupVersionKind()
+				log.Printf("labeler.go: error getting gvr from gvk for %v/%v/%v: %v\n", gvk.Group, gvk.Version, gvk.Kind, err)
 			}
+			unmapped = append(unmapped, runtimeObj)
 		}
-
-		resource := c.ResourceStruct{
-			Group:      gvr.Group,
-			Version:    gvr.Version,
-			Resource:   gvr.Resource,
-			Namespace:  runtimeObj.GetNamespace(),
-			ObjectName: runtimeObj.GetName(),
+	})
+	if err != nil || len(unmapped) == 0 {
+		return err
+	}
+
+	// the input may define the CRDs of the objects that could not be mapped, once they are established the mapper
+	// has to discover them
+	if len(crds) > 0 {
+		k.WaitForCRDs(crds, p)
+		mapper.Reset()
+	}
+	for _, runtimeObj := range unmapped {
+		if err := addManifestObject(runtimeObj, mapper, defaultNamespace, p); err != nil {
+			gvk := runtimeObj.GroupVersionKind()
+			failure := fmt.Sprintf("%v/%v/%v %q in namespace %q: unknown kind, is its CRD installed? (%v)\n", gvk.Group, gvk.Version, gvk.Kind, runtimeObj.GetName(), runtimeObj.GetNamespace(), err)
+			c.RunResults.FailedToLabel = append(c.RunResults.FailedToLabel, failure)
 		}
-		p.Resources[resource] = yamlBytes
-		// log.Printf("labeler.go: resource: %v %v\n", resource, string(yamlBytes))
+	}
+	return nil
+}
 
-		// if err != nil {
-		// 	// objName := strings.ReplaceAll(runtimeObj.GetName(), "release-name-", starHelmChartReleaseName+"-")
-		// 	// p.setLabel(runtimeObj.GetNamespace(), objName, gvr)
-		// }
+// addManifestObject adds an object from a manifest to p.Resources
+func addManifestObject(runtimeObj *unstructured.Unstructured, mapper meta.RESTMapper, defaultNamespace string, p c.ParamsStruct) error {
+	resource, err := manifestResource(runtimeObj, mapper, defaultNamespace)
+	if err != nil {
+		return err
+	}
 
+	// convert the object to its YAML byte representation for the plugins
+	yamlBytes, err := yaml.Marshal(runtimeObj.Object)
+	if err != nil {
+		log.Printf("labeler.go: error marshaling YAML: %v\n", err)
+		return nil
 	}
+	p.Resources[resource] = yamlBytes
 	return nil
 }
 
+// manifestResource resolves the resource and namespace of an object from a manifest
+func manifestResource(runtimeObj *unstructured.Unstructured, mapper meta.RESTMapper, defaultNamespace string) (c.ResourceStruct, error) {
+	gvk := runtimeObj.GroupVersionKind()
+	gvr, namespaced, err := getGVRFromGVK(mapper, gvk)
+	if err != nil {
+		return c.ResourceStruct{}, err
+	}
+	c.RunResults.RecordKind(gvr, gvk.Kind)
+
+	// charts usually leave the namespace out and let helm install into -n, cluster-scoped objects have none
+	namespace := ""
+	if namespaced {
+		namespace = runtimeObj.GetNamespace()
+		if namespace == "" {
+			namespace = defaultNamespace
+		}
+	}
+
+	return c.ResourceStruct{
+		Group:      gvr.Group,
+		Version:    gvr.Version,
+		Resource:   gvr.Resource,
+		Namespace:  namespace,
+		ObjectName: runtimeObj.GetName(),
+	}, nil
+}
+
 func getPluginNamesAndArgs(p c.ParamsStruct) {
 	//
 	// COMPILE-TIME PLUGIN DISCOVERY SECTION
@@ -564,6 +661,14 @@ func getPluginNamesAndArgs(p c.ParamsStruct) {
 			pluginFNnames := pluginImpl()
 			log.Println("Plugin function names:", pluginFNnames)
 
+			if sym, err := pi.Lookup("PluginBuffered"); err == nil {
+				if pluginBuffered, ok := sym.(func() []string); ok {
+					for _, methodName := range pluginBuffered() {
+						bufferedPlugins[methodName] = true
+					}
+				}
+			}
+
 			for _, methodName := range pluginFNnames {
 				sym, err = pi.Lookup(methodName)
 				if err != nil {
@@ -584,24 +689,44 @@ func getPluginNamesAndArgs(p c.ParamsStruct) {
 	}
 }
 
-func getFile() (*os.File, error) {
+// getFile reads the manifests at --file: a single file, a directory of manifests (recursively with -R), or a
+// kustomization directory, which is rendered with 'kubectl kustomize'
+func getFile(p c.ParamsStruct) ([]byte, error) {
 	if c.Flags.Filepath == "" {
 		return nil, errors.New("labeler.go: please input a file")
 	}
 	if !fileExists(c.Flags.Filepath) {
 		return nil, errors.New("labeler.go: the file provided does not exist")
 	}
-	file, e := os.Open(c.Flags.Filepath)
+	if isKustomization(c.Flags.Filepath) {
+		output, e := renderKustomization(c.Flags.Filepath, p)
+		if e != nil {
+			return nil, errors.Wrapf(e,
+				"labeler.go: unable to render the kustomization %s", c.Flags.Filepath)
+		}
+		return output, nil
+	}
+	manifests, e := readManifestFiles([]string{c.Flags.Filepath}, c.Flags.Recursive)
 	if e != nil {
 		return nil, errors.Wrapf(e,
 			"labeler.go: unable to read the file %s", c.Flags.Filepath)
 	}
-	return file, nil
+	return manifests, nil
 }
 
-func isYAML(line string) bool {
-	// Check if the line starts with "---" or starts with whitespace followed by "-"
-	return strings.HasPrefix(strings.TrimSpace(line), "-") || strings.HasPrefix(line, "---")
+// isKustomization reports whether path is a directory holding a kustomization file
+func isKustomization(path string) bool {
+	for _, name := range []string{"kustomization.yaml", "kustomization.yml", "Kustomization"} {
+		if info, err := os.Stat(filepath.Join(path, name)); err == nil && !info.IsDir() {
+			return true
+		}
+	}
+	return false
+}
+
+// renderKustomization returns the objects a kustomization produces, like 'kubectl kustomize <dir>'
+func renderKustomization(dir string, p c.ParamsStruct) ([]byte, error) {
+	return p.RunCmd("kubectl", []string{"kustomize", dir}, true)
 }
 
 func IsInputFromPipe() bool {
@@ -614,47 +739,185 @@ func fileExists(filename string) bool {
 	return err == nil
 }
 
-func SwitchContext(p c.ParamsStruct) (*kubernetes.Clientset, *rest.Config, *dynamic.DynamicClient) {
-	var err error
-	var kubeConfigPath string
+// kubeconfigLoadingRules returns the standard kubeconfig loading rules, like kubectl: the --kubeconfig file, or the
+// files of the KUBECONFIG list merged, or ~/.kube/config
+func kubeconfigLoadingRules(kubeconfig string, p c.ParamsStruct) *clientcmd.ClientConfigLoadingRules {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = kubeconfig
+	if rules.ExplicitPath == "" && os.Getenv(clientcmd.RecommendedConfigPathEnvVar) == "" {
+		rules.Precedence = []string{filepath.Join(p.HomeDir, ".kube", "config")}
+	}
+	return rules
+}
+
+// clientConfig returns the kubeconfig labeler operates on, for the cluster resolveClusterTarget finds and with the
+// token and identity overrides of the command line applied. Without any kubeconfig it falls back to the service
+// account of the pod labeler runs in.
+func clientConfig(p c.ParamsStruct) (clientcmd.ClientConfig, error) {
+	target, err := resolveClusterTarget(p)
+	if err != nil {
+		return nil, err
+	}
+	overrides := &clientcmd.ConfigOverrides{}
+	overrides.CurrentContext = target.Context
+	overrides.ClusterInfo.Server = target.Server
+
+	// labeler patches with the identity of the command it wraps (in piped mode the command that produced the input),
+	// so that it cannot touch objects that identity has no access to. --l-as etc. set it in piped mode.
+	args := append(globalAuthArgs(strings.Fields(p.OriginalCmd)), globalAuthArgs(os.Args[1:])...)
+	overrides.AuthInfo.Token = firstNonEmpty(append([]string{c.Flags.Token}, flagValues(args, "--token", "--kube-token", "--l-token")...)...)
+	overrides.AuthInfo.Impersonate = firstNonEmpty(append(flagValues(args, "--as", "--kube-as-user", "--l-as"), c.Flags.As)...)
+	overrides.AuthInfo.ImpersonateUID = firstNonEmpty(append(flagValues(args, "--as-uid", "--l-as-uid"), c.Flags.AsUID)...)
+	for _, group := range append(flagValues(args, "--as-group", "--kube-as-group", "--l-as-group"), c.Flags.AsGroups...) {
+		if !slices.Contains(overrides.AuthInfo.ImpersonateGroups, group) {
+			overrides.AuthInfo.ImpersonateGroups = append(overrides.AuthInfo.ImpersonateGroups, group)
+		}
+	}
+	overrides.Context.AuthInfo = firstNonEmpty(append(flagValues(args, "--user", "--l-user"), c.Flags.User)...)
+	return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(kubeconfigLoadingRules(target.Kubeconfig, p), overrides), nil
+}
+
+// subcommandAuthFlags are flags of kubectl subcommands that have the name of a global auth flag, e.g. the subject of
+// kubectl create rolebinding --user=bob, by the words the subcommand is given with
+var subcommandAuthFlags = []struct {
+	command []string
+	flags   []string
+}{
+	{command: []string{"create", "rolebinding"}, flags: []string{"--user"}},
+	{command: []string{"create", "clusterrolebinding"}, flags: []string{"--user"}},
+	{command: []string{"config", "set-context"}, flags: []string{"--user"}},
+	{command: []string{"config", "set-credentials"}, flags: []string{"--token"}},
+}
+
+// globalAuthArgs drops the flags of a kubectl command line that belong to its subcommand rather than select the
+// identity kubectl talks to the cluster with
+func globalAuthArgs(args []string) []string {
+	var shadowed []string
+	for _, sub := range subcommandAuthFlags {
+		if i := slices.Index(args, sub.command[0]); i != -1 && slices.Contains(args[i+1:], sub.command[1]) {
+			shadowed = append(shadowed, sub.flags...)
+		}
+	}
+	if len(shadowed) == 0 {
+		return args
+	}
+	var global []string
+	for i := 0; i < len(args); i++ {
+		name, _, hasValue := strings.Cut(args[i], "=")
+		if slices.Contains(shadowed, name) {
+			if !hasValue {
+				i++
+			}
+			continue
+		}
+		global = append(global, args[i])
+	}
+	return global
+}
+
+// kubeconfigSource describes where the configuration loaded with the rules comes from
+func kubeconfigSource(rules *clientcmd.ClientConfigLoadingRules) string {
+	if rules.ExplicitPath != "" {
+		return "--kubeconfig " + rules.ExplicitPath
+	}
+	var files []string
+	for _, file := range rules.GetLoadingPrecedence() {
+		if fileExists(file) {
+			files = append(files, file)
+		}
+	}
+	if len(files) == 0 {
+		return "in-cluster service account"
+	}
+	if os.Getenv(clientcmd.RecommendedConfigPathEnvVar) != "" {
+		return "KUBECONFIG " + strings.Join(files, string(os.PathListSeparator))
+	}
+	return files[0]
+}
 
-	if c.Flags.Kubeconfig == "" {
-		kubeConfigPath = os.Getenv("KUBECONFIG")
-	} else {
-		kubeConfigPath = filepath.Join(c.Flags.Kubeconfig)
+// flagValues returns the values of the flags in args, given as --flag=value or --flag value, in order
+func flagValues(args []string, names ...string) []string {
+	var values []string
+	for i, arg := range args {
+		for _, name := range names {
+			if arg == name && i+1 < len(args) {
+				values = append(values, args[i+1])
+			} else if strings.HasPrefix(arg, name+"=") {
+				values = append(values, strings.TrimPrefix(arg, name+"="))
+			}
+		}
 	}
-	// log.Println("labeler.go: kubeconfig path:", kubeConfigPath)
-	// if kubeconfig is still empty, use the default path
-	if kubeConfigPath == "" {
-		kubeConfigPath = filepath.Join(p.HomeDir, ".kube", "config")
+	return values
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
 	}
-	// log.Println("labeler.go: kubeconfig path:", kubeConfigPath)
+	return ""
+}
 
-	// load kubeconfig from file
-	apiConfig, err := clientcmd.LoadFromFile(kubeConfigPath)
+// currentContextName returns the name of the context labeler operates on
+func currentContextName(p c.ParamsStruct) string {
+	target, err := resolveClusterTarget(p)
+	if err != nil {
+		return ""
+	}
+	if target.Context != "" {
+		return target.Context
+	}
+	config, err := clientConfig(p)
+	if err != nil {
+		return ""
+	}
+	apiConfig, err := config.RawConfig()
+	if err != nil {
+		return ""
+	}
+	return apiConfig.CurrentContext
+}
+
+func SwitchContext(p c.ParamsStruct) (kubernetes.Interface, *rest.Config, dynamic.Interface) {
+	var err error
+	// labeler refuses to label when it cannot be sure to talk to the cluster the command changed
+	target, err := resolveClusterTarget(p)
+	if err != nil {
+		log.Printf("labeler.go: error (cluster): %v\n", err)
+		os.Exit(1)
+	}
+	config, err := clientConfig(p)
 	if err != nil {
 		log.Printf("labeler.go: error loading kubeconfig: %q\n", err)
 		os.Exit(1)
 	}
 
-	// log.Printf("labeler.go: current context: %q %q %q\n", apiConfig.CurrentContext, c.Flags.Context, p.Params["context"])
-	if p.Params["context"] != "" {
+	if target.Context != "" {
 		// check if the specified context exists in the kubeconfig
-		if _, exists := apiConfig.Contexts[p.Params["context"]]; !exists {
-			log.Printf("labeler.go: context %q does not exist in the kubeconfig\n", p.Params["context"])
+		apiConfig, err := config.RawConfig()
+		if err != nil {
+			log.Printf("labeler.go: error loading kubeconfig: %q\n", err)
+			os.Exit(1)
+		}
+		if _, exists := apiConfig.Contexts[target.Context]; !exists {
+			log.Printf("labeler.go: context %q does not exist in the kubeconfig\n", target.Context)
 			os.Exit(1)
 		}
-		// switch the current context in the kubeconfig
-		apiConfig.CurrentContext = p.Params["context"]
 	}
 
 	// create a new clientset with the updated config
-	clientConfig := clientcmd.NewDefaultClientConfig(*apiConfig, &clientcmd.ConfigOverrides{})
-	restConfig, err := clientConfig.ClientConfig()
+	restConfig, err := config.ClientConfig()
 	if err != nil {
 		log.Printf("labeler.go: error creating clientset config: %v\n", err)
 		os.Exit(1)
 	}
+	if p.Flags["l-debug"] {
+		log.Printf("labeler.go: [debug] cluster %v (context %q) from %v\n", restConfig.Host, currentContextName(p), kubeconfigSource(kubeconfigLoadingRules(target.Kubeconfig, p)))
+		if restConfig.Impersonate.UserName != "" {
+			log.Printf("labeler.go: [debug] acting as %q (groups %v)\n", restConfig.Impersonate.UserName, restConfig.Impersonate.Groups)
+		}
+	}
 	ocClientset, err := kubernetes.NewForConfig(restConfig)
 	if err != nil {
 		log.Printf("labeler.go: error creating clientset: %v\n", err)
@@ -669,36 +932,40 @@ func SwitchContext(p c.ParamsStruct) (*kubernetes.Clientset, *rest.Config, *dyna
 	return ocClientset, restConfig, ocDynamicClient
 }
 
-func createCachedDiscoveryClient(restConfigCoreOrWds rest.Config, p c.ParamsStruct) (*restmapper.DeferredDiscoveryRESTMapper, error) {
-	// create a cached discovery client for the provided config
-	cachedDiscoveryClient, err := disk.NewCachedDiscoveryClientForConfig(&restConfigCoreOrWds, p.HomeDir, ".cache", 60)
-	if err != nil {
-		log.Printf("labeler.go: could not get cacheddiscoveryclient: %v", err)
-		// handle error
-	}
-	mapper := restmapper.NewDeferredDiscoveryRESTMapper(cachedDiscoveryClient)
-	return mapper, nil
-}
-
-func getGVRFromGVK(mapper *restmapper.DeferredDiscoveryRESTMapper, gvk schema.GroupVersionKind) (schema.GroupVersionResource, error) {
+// getGVRFromGVK returns the resource of a kind and whether its objects are namespaced
+func getGVRFromGVK(mapper meta.RESTMapper, gvk schema.GroupVersionKind) (schema.GroupVersionResource, bool, error) {
 	mapping, err := mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
 	if err != nil {
-		return schema.GroupVersionResource{}, fmt.Errorf("failed to get REST mapping: %v", err)
+		return schema.GroupVersionResource{}, false, fmt.Errorf("failed to get REST mapping: %v", err)
 	}
 	gvr := mapping.Resource
 	if gvr.Resource == "" {
-		return schema.GroupVersionResource{}, fmt.Errorf("resource name not found for kind %s/%s %s", gvk.Group, gvk.Version, gvk.Kind)
+		return schema.GroupVersionResource{}, false, fmt.Errorf("resource name not found for kind %s/%s %s", gvk.Group, gvk.Version, gvk.Kind)
 	}
 
-	return gvr, nil
+	return gvr, mapping.Scope.Name() == meta.RESTScopeNameNamespace, nil
 }
 
-func decodeYAML(yamlBytes []byte) (*unstructured.Unstructured, error) {
-	obj := &unstructured.Unstructured{}
-	dec := k8sYAML.NewYAMLOrJSONDecoder(bytes.NewReader(yamlBytes), 4096)
-	err := dec.Decode(obj)
-	if err != nil {
-		return nil, err
+// addNamespaceToResources adds the namespace the objects of the run default to, so that it is labeled with them
+func addNamespaceToResources(p c.ParamsStruct) {
+	k.SetNamespaceArg(p)
+	k.AddNamespaceToResources(p, commandNamespace(p))
+}
+
+// commandNamespace returns the namespace that the helm or kubectl command put objects without a namespace in: its
+// -n flag, or the namespace of the kubeconfig context, or "default"
+func commandNamespace(p c.ParamsStruct) string {
+	if p.Params["namespaceArg"] != "" {
+		return p.Params["namespaceArg"]
+	}
+	if namespace := namespaceFromArgs(strings.Fields(p.OriginalCmd)); namespace != "" {
+		return namespace
+	}
+	// the namespace of the context, or of the pod labeler runs in
+	if config, err := clientConfig(p); err == nil {
+		if namespace, _, err := config.Namespace(); err == nil && namespace != "" {
+			return namespace
+		}
 	}
-	return obj, nil
+	return "default"
 }
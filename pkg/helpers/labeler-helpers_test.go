@@ -0,0 +1,147 @@
+package helpers
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	c "github.com/clubanderson/labeler/pkg/common"
+)
+
+const namespaceKubeconfig = `apiVersion: v1
+kind: Config
+clusters:
+- name: kind
+  cluster:
+    server: https://127.0.0.1:6443
+users:
+- name: kind
+  user:
+    token: secret
+contexts:
+- name: team-a
+  context:
+    cluster: kind
+    user: kind
+    namespace: team-a
+- name: plain
+  context:
+    cluster: kind
+    user: kind
+current-context: team-a
+`
+
+func TestCommandNamespace(t *testing.T) {
+	kubeconfig := filepath.Join(t.TempDir(), "config")
+	if err := os.WriteFile(kubeconfig, []byte(namespaceKubeconfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		params  map[string]string
+		command string
+		context string
+		want    string
+	}{
+		{name: "--namespace", params: map[string]string{"namespace": "ns1"}, want: "ns1"},
+		{name: "-n", params: map[string]string{"n": "ns1"}, want: "ns1"},
+		{name: "-n of the command", command: "kubectl apply -f app.yaml -n ns2", want: "ns2"},
+		{name: "namespace of the context", want: "team-a"},
+		{name: "context without namespace", context: "plain", want: "default"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("KUBECONFIG", kubeconfig)
+			t.Setenv("KUBERNETES_SERVICE_HOST", "")
+			saved := c.Flags
+			defer func() { c.Flags = saved }()
+			c.Flags.Kubeconfig, c.Flags.Context, c.Flags.Server = "", tt.context, ""
+
+			p := c.ParamsStruct{
+				Params:      map[string]string{},
+				Flags:       map[string]bool{},
+				Resources:   map[c.ResourceStruct][]byte{},
+				OriginalCmd: tt.command,
+			}
+			for key, value := range tt.params {
+				p.Params[key] = value
+			}
+			addNamespaceToResources(p)
+			if got := commandNamespace(p); got != tt.want {
+				t.Errorf("commandNamespace() = %q, want %q", got, tt.want)
+			}
+			namespace := c.ResourceStruct{Version: "v1", Resource: "namespaces", ObjectName: tt.want}
+			if _, ok := p.Resources[namespace]; !ok || len(p.Resources) != 1 {
+				t.Errorf("namespaces to label = %v, want %q", p.Resources, tt.want)
+			}
+		})
+	}
+}
+
+func TestGlobalAuthArgs(t *testing.T) {
+	tests := []struct {
+		command string
+		want    []string
+	}{
+		{
+			command: "k create rolebinding view-bob --clusterrole=view --user=bob -n team-a -l a=b",
+			want:    []string{"k", "create", "rolebinding", "view-bob", "--clusterrole=view", "-n", "team-a", "-l", "a=b"},
+		},
+		{
+			command: "kubectl create clusterrolebinding view-bob --clusterrole view --user bob --as admin",
+			want:    []string{"kubectl", "create", "clusterrolebinding", "view-bob", "--clusterrole", "view", "--as", "admin"},
+		},
+		{
+			command: "kubectl get rolebinding view-bob --user=admin",
+			want:    []string{"kubectl", "get", "rolebinding", "view-bob", "--user=admin"},
+		},
+		{
+			command: "kubectl apply -f app.yaml --user admin --token=secret",
+			want:    []string{"kubectl", "apply", "-f", "app.yaml", "--user", "admin", "--token=secret"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.command, func(t *testing.T) {
+			if got := globalAuthArgs(strings.Fields(tt.command)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("globalAuthArgs() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// the subject of a role binding is not the user labeler talks to the cluster as
+func TestClientConfigRoleBindingUser(t *testing.T) {
+	kubeconfig := filepath.Join(t.TempDir(), "config")
+	if err := os.WriteFile(kubeconfig, []byte(namespaceKubeconfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("KUBECONFIG", kubeconfig)
+	t.Setenv("KUBERNETES_SERVICE_HOST", "")
+	saved := c.Flags
+	defer func() { c.Flags = saved }()
+	c.Flags.Kubeconfig, c.Flags.Context, c.Flags.Server, c.Flags.Token = "", "", "", ""
+	c.Flags.As, c.Flags.AsGroups, c.Flags.AsUID, c.Flags.User = "", nil, "", ""
+
+	tests := []struct {
+		command string
+		wantErr bool
+	}{
+		{command: "kubectl create rolebinding view-bob --clusterrole=view --user=bob -n team-a"},
+		{command: "kubectl create clusterrolebinding view-bob --clusterrole=view --user bob"},
+		{command: "kubectl apply -f app.yaml --user=bob", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.command, func(t *testing.T) {
+			config, err := clientConfig(c.ParamsStruct{OriginalCmd: tt.command})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := config.ClientConfig(); (err != nil) != tt.wantErr {
+				t.Errorf("ClientConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,270 @@
+package helpers
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strings"
+
+	c "github.com/clubanderson/labeler/pkg/common"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// kubectlObjectStruct is an object reported by kubectl, e.g. "deployment.apps/nginx configured"
+type kubectlObjectStruct struct {
+	Group string
+	Kind  string // lower case, as printed by kubectl
+	Name  string
+	Verb  string // empty for -o name output
+}
+
+// kubectlVerbs are the status verbs kubectl prints after an object, and whether the object exists afterwards
+var kubectlVerbs = map[string]bool{
+	"created":            true,
+	"configured":         true,
+	"unchanged":          true,
+	"serverside-applied": true,
+	"replaced":           true,
+	"patched":            true,
+	"labeled":            true,
+	"annotated":          true,
+	"edited":             true,
+	"deleted":            false,
+	"pruned":             false,
+}
+
+// parseKubectlOutput parses the human and -o name output of kubectl apply, create and replace. Lines that are not
+// an object report (errors, warnings, tables) are returned as unparsed.
+func parseKubectlOutput(lines []string) ([]kubectlObjectStruct, []string) {
+	var objects []kubectlObjectStruct
+	var unparsed []string
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		obj, ok := parseKubectlLine(line)
+		if !ok {
+			unparsed = append(unparsed, line)
+			continue
+		}
+		objects = append(objects, obj)
+	}
+	return objects, unparsed
+}
+
+func parseKubectlLine(line string) (kubectlObjectStruct, bool) {
+	var obj kubectlObjectStruct
+	// dry runs print e.g. "configmap/foo created (server dry run)"
+	line = strings.TrimSuffix(line, " (dry run)")
+	line = strings.TrimSuffix(line, " (server dry run)")
+
+	fields := strings.Fields(line)
+	var typeName string
+	switch len(fields) {
+	case 1:
+		// -o name
+		typeName = fields[0]
+	case 2:
+		typeName, obj.Verb = fields[0], fields[1]
+	case 3:
+		// kubectl delete prints: deployment.apps "nginx" deleted
+		if !strings.HasPrefix(fields[1], `"`) || !strings.HasSuffix(fields[1], `"`) {
+			return obj, false
+		}
+		typeName, obj.Verb = fields[0]+"/"+strings.Trim(fields[1], `"`), fields[2]
+	default:
+		return obj, false
+	}
+	if _, ok := kubectlVerbs[obj.Verb]; obj.Verb != "" && !ok {
+		return obj, false
+	}
+
+	resourceType, name, found := strings.Cut(typeName, "/")
+	if !found || resourceType == "" || name == "" || strings.ContainsAny(resourceType, ":\"'") {
+		return obj, false
+	}
+	obj.Kind, obj.Group, _ = strings.Cut(resourceType, ".")
+	obj.Name = name
+	return obj, true
+}
+
+// kubectlCommandArgs returns the args of the kubectl command that produced the output, e.g. "kubectl apply -f x.yaml"
+func kubectlCommandArgs(p c.ParamsStruct) []string {
+	return strings.Fields(p.OriginalCmd)
+}
+
+// kubectlWritesObjects reports whether the kubectl command creates or updates the objects it reports
+func kubectlWritesObjects(args []string, p c.ParamsStruct) bool {
+	if p.Flags["apply"] || p.Flags["create"] || p.Flags["replace"] {
+		return true
+	}
+	for _, arg := range args {
+		if arg == "apply" || arg == "create" || arg == "replace" {
+			return true
+		}
+	}
+	return false
+}
+
+// kubectlInputs reports whether a kubectl command reads manifests from stdin (-f -), and whether it reads manifests
+// from anywhere else (files, URLs, -k)
+func kubectlInputs(args []string) (bool, bool) {
+	readsStdin, readsOther := false, false
+	for _, file := range fileArgs(args) {
+		if file == "-" {
+			readsStdin = true
+		} else {
+			readsOther = true
+		}
+	}
+	for _, arg := range args {
+		if arg == "-k" || arg == "--kustomize" || strings.HasPrefix(arg, "-k=") || strings.HasPrefix(arg, "--kustomize=") {
+			readsOther = true
+		}
+	}
+	return readsStdin, readsOther
+}
+
+// kustomizeDirs returns every kustomization given to kubectl with -k or --kustomize
+func kustomizeDirs(args []string) []string {
+	var dirs []string
+	for i, arg := range args {
+		if (arg == "-k" || arg == "--kustomize") && i+1 < len(args) {
+			dirs = append(dirs, args[i+1])
+		} else if strings.HasPrefix(arg, "-k=") || strings.HasPrefix(arg, "--kustomize=") {
+			dirs = append(dirs, arg[strings.Index(arg, "=")+1:])
+		}
+	}
+	return dirs
+}
+
+// traverseKustomizations adds the objects the kustomizations render to p.Resources. The rendered objects are
+// authoritative for kubectl -k: they carry the namespace, namePrefix/nameSuffix and generator hashes of the
+// kustomization, and their full YAML is available to the plugins.
+func traverseKustomizations(dirs []string, p c.ParamsStruct) error {
+	for _, dir := range dirs {
+		data, err := renderKustomization(dir, p)
+		if err != nil {
+			return fmt.Errorf("unable to render the kustomization %s: %v", dir, err)
+		}
+		err = traverseHelmOutput(bytes.NewReader(data), p)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// namespaceFromArgs returns the namespace given to kubectl with -n or --namespace
+func namespaceFromArgs(args []string) string {
+	for i, arg := range args {
+		if (arg == "-n" || arg == "--namespace") && i+1 < len(args) {
+			return args[i+1]
+		}
+		if strings.HasPrefix(arg, "-n=") || strings.HasPrefix(arg, "--namespace=") {
+			return arg[strings.Index(arg, "=")+1:]
+		}
+	}
+	return ""
+}
+
+// manifestNamespaces returns the namespaces declared by the manifests given to kubectl with -f or -k, keyed by
+// objectKey. An object name may appear in more than one namespace (kubectl apply -R), so the namespaces are kept in
+// manifest order, which is the order kubectl reports them in.
+func manifestNamespaces(args []string, p c.ParamsStruct) map[string][]string {
+	namespaces := map[string][]string{}
+	var manifests bytes.Buffer
+
+	var files []string
+	recursive := false
+	for _, arg := range args {
+		if arg == "-R" || arg == "--recursive" || arg == "--recursive=true" {
+			recursive = true
+		}
+	}
+	for _, file := range fileArgs(args) {
+		// stdin has already been consumed by kubectl, and URLs are not fetched twice
+		if file == "-" || strings.Contains(file, "://") {
+			continue
+		}
+		files = append(files, file)
+	}
+	if len(files) > 0 {
+		data, err := readManifestFiles(files, recursive)
+		if err != nil {
+			if p.Flags["l-debug"] {
+				log.Printf("labeler.go: [debug] could not read manifests %v: %v\n", files, err)
+			}
+		} else {
+			appendDocument(&manifests, data)
+		}
+	}
+	for _, dir := range kustomizeDirs(args) {
+		data, err := renderKustomization(dir, p)
+		if err != nil {
+			if p.Flags["l-debug"] {
+				log.Printf("labeler.go: [debug] could not render kustomization %v: %v\n", dir, err)
+			}
+			continue
+		}
+		appendDocument(&manifests, data)
+	}
+	if manifests.Len() == 0 {
+		return namespaces
+	}
+
+	err := decodeManifests(&manifests, p.Flags["l-debug"], func(obj *unstructured.Unstructured) {
+		key := objectKey(obj.GroupVersionKind().Group, obj.GetKind(), obj.GetName())
+		namespaces[key] = append(namespaces[key], obj.GetNamespace())
+	})
+	if err != nil && p.Flags["l-debug"] {
+		log.Printf("labeler.go: [debug] could not decode manifests: %v\n", err)
+	}
+	return namespaces
+}
+
+func objectKey(group, kind, name string) string {
+	return fmt.Sprintf("%v/%v/%v", strings.ToLower(group), strings.ToLower(kind), name)
+}
+
+// kubectlObjectResource resolves the resource and namespace of an object reported by kubectl. Cluster-scoped objects
+// get no namespace, namespaced objects get the namespace from their manifest, or the -n namespace kubectl used when
+// the manifest does not set one.
+func kubectlObjectResource(obj kubectlObjectStruct, mapper meta.RESTMapper, namespaces map[string][]string, defaultNamespace string) (c.ResourceStruct, error) {
+	// kubectl prints the lower case kind, which the discovery mapper knows as the singular resource name
+	gvk, err := mapper.KindFor(schema.GroupVersionResource{Group: obj.Group, Resource: obj.Kind})
+	if err != nil {
+		return c.ResourceStruct{}, err
+	}
+	mapping, err := mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if err != nil {
+		return c.ResourceStruct{}, err
+	}
+	c.RunResults.RecordKind(mapping.Resource, mapping.GroupVersionKind.Kind)
+
+	namespace := ""
+	if mapping.Scope.Name() == meta.RESTScopeNameNamespace {
+		namespace = defaultNamespace
+		key := objectKey(obj.Group, obj.Kind, obj.Name)
+		if queue := namespaces[key]; len(queue) > 0 {
+			if queue[0] != "" {
+				namespace = queue[0]
+			}
+			namespaces[key] = queue[1:]
+		}
+		if namespace == "" {
+			namespace = "default"
+		}
+	}
+
+	return c.ResourceStruct{
+		Group:      mapping.Resource.Group,
+		Version:    mapping.Resource.Version,
+		Resource:   mapping.Resource.Resource,
+		Namespace:  namespace,
+		ObjectName: obj.Name,
+	}, nil
+}
@@ -0,0 +1,37 @@
+package helpers
+
+import "testing"
+
+func TestParseKubectlLine(t *testing.T) {
+	tests := []struct {
+		line string
+		want kubectlObjectStruct
+		ok   bool
+	}{
+		{line: "deployment.apps/nginx configured", want: kubectlObjectStruct{Group: "apps", Kind: "deployment", Name: "nginx", Verb: "configured"}, ok: true},
+		{line: "namespace/sample created", want: kubectlObjectStruct{Kind: "namespace", Name: "sample", Verb: "created"}, ok: true},
+		{line: "configmap/foo created (server dry run)", want: kubectlObjectStruct{Kind: "configmap", Name: "foo", Verb: "created"}, ok: true},
+		{line: "configmap/foo serverside-applied (dry run)", want: kubectlObjectStruct{Kind: "configmap", Name: "foo", Verb: "serverside-applied"}, ok: true},
+		{line: "clusterrole.rbac.authorization.k8s.io/secrets-unsealer", want: kubectlObjectStruct{Group: "rbac.authorization.k8s.io", Kind: "clusterrole", Name: "secrets-unsealer"}, ok: true},
+		{line: `deployment.apps "nginx" deleted`, want: kubectlObjectStruct{Group: "apps", Kind: "deployment", Name: "nginx", Verb: "deleted"}, ok: true},
+		{line: "service/nginx pruned", want: kubectlObjectStruct{Kind: "service", Name: "nginx", Verb: "pruned"}, ok: true},
+		{line: "deployment.apps/nginx restarted", ok: false},
+		{line: `deployment.apps nginx deleted`, ok: false},
+		{line: "Warning: resource deployments/nginx is missing the last-applied-configuration annotation", ok: false},
+		{line: `Error from server (NotFound): namespaces "x" not found`, ok: false},
+		{line: "NAME READY STATUS", ok: false},
+		{line: "https://example.com/app", ok: false},
+		{line: "nginx", ok: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			got, ok := parseKubectlLine(tt.line)
+			if ok != tt.ok {
+				t.Fatalf("parseKubectlLine() ok = %v, want %v", ok, tt.ok)
+			}
+			if ok && got != tt.want {
+				t.Errorf("parseKubectlLine() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package helpers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8sYAML "k8s.io/apimachinery/pkg/util/yaml"
+)
+
+// decodeManifests decodes a stream of YAML documents, JSON objects, or a mix of both, and calls fn for every object.
+// List and *List wrappers (kubectl get -o json, v1/List documents) are expanded into their items. Documents that are
+// not Kubernetes objects (helm NOTES, kubectl status lines) are skipped. A stream that starts with JSON is decoded
+// object by object, as it has no "---" separators.
+func decodeManifests(r io.Reader, debug bool, fn func(obj *unstructured.Unstructured)) error {
+	br := bufio.NewReader(r)
+	if startsWithJSON(br) {
+		// unlike YAMLOrJSONDecoder, which first fills a buffer, json.Decoder decodes each object as soon as it is read
+		decodeObjects(json.NewDecoder(br), debug, fn)
+		return nil
+	}
+	reader := k8sYAML.NewYAMLReader(br)
+	for {
+		doc, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if len(bytes.TrimSpace(doc)) == 0 {
+			continue
+		}
+		// a document may hold several JSON objects that are not separated by "---"
+		decodeObjects(k8sYAML.NewYAMLOrJSONDecoder(bytes.NewReader(doc), 4096), debug, fn)
+	}
+}
+
+// decodeObjects calls fn for every object of a decoder, up to the first value that is not a Kubernetes object
+func decodeObjects(decoder interface{ Decode(into interface{}) error }, debug bool, fn func(obj *unstructured.Unstructured)) {
+	for {
+		obj := &unstructured.Unstructured{}
+		err := decoder.Decode(obj)
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			if debug {
+				log.Printf("labeler.go: [debug] skipping document that is not a kubernetes object: %v\n", err)
+			}
+			return
+		}
+		expandList(obj, fn)
+	}
+}
+
+// startsWithJSON reports whether the first character of the input, after any whitespace, starts a JSON object
+func startsWithJSON(r *bufio.Reader) bool {
+	for i := 1; ; i++ {
+		b, err := r.Peek(i)
+		if len(b) < i || err != nil {
+			return false
+		}
+		switch b[i-1] {
+		case ' ', '\t', '\r', '\n':
+			continue
+		}
+		return b[i-1] == '{'
+	}
+}
+
+func expandList(obj *unstructured.Unstructured, fn func(obj *unstructured.Unstructured)) {
+	if obj.GetKind() == "" {
+		return
+	}
+	if strings.HasSuffix(obj.GetKind(), "List") && obj.IsList() {
+		_ = obj.EachListItem(func(item runtime.Object) error {
+			if u, ok := item.(*unstructured.Unstructured); ok {
+				expandList(u, fn)
+			}
+			return nil
+		})
+		return
+	}
+	fn(obj)
+}
+
+// skipToManifests drops text printed before the first document, such as the header of 'helm install --debug'. The
+// manifests are returned as a part of input, not a copy.
+func skipToManifests(input []byte) []byte {
+	if bytes.HasPrefix(bytes.TrimSpace(input), []byte("{")) {
+		return input
+	}
+	if i := bytes.Index(input, []byte("---\n")); i != -1 {
+		return input[i:]
+	}
+	return input
+}
+
+// isManifestStart reports whether a line starts a YAML document or a JSON object
+func isManifestStart(line string) bool {
+	return isJSON(line) || strings.HasPrefix(line, "---") || strings.HasPrefix(line, "apiVersion:") || strings.HasPrefix(line, "kind:")
+}
+
+func isJSON(line string) bool {
+	return strings.HasPrefix(strings.TrimSpace(line), "{")
+}
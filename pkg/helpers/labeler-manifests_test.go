@@ -0,0 +1,116 @@
+package helpers
+
+import (
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestDecodeManifests(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []string // kind/name of the decoded objects
+	}{
+		{
+			name:  "yaml documents",
+			input: "---\napiVersion: v1\nkind: Service\nmetadata:\n  name: a\n---\n# Source: chart/templates/cm.yaml\napiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: b\n",
+			want:  []string{"Service/a", "ConfigMap/b"},
+		},
+		{
+			name:  "json stream without separators",
+			input: "\n{\"apiVersion\":\"v1\",\"kind\":\"Service\",\"metadata\":{\"name\":\"a\"}}\n{\"apiVersion\":\"v1\",\"kind\":\"ConfigMap\",\"metadata\":{\"name\":\"b\"}}\n",
+			want:  []string{"Service/a", "ConfigMap/b"},
+		},
+		{
+			name:  "json objects in a yaml document",
+			input: "apiVersion: v1\nkind: Service\nmetadata:\n  name: a\n---\n{\"apiVersion\":\"v1\",\"kind\":\"ConfigMap\",\"metadata\":{\"name\":\"b\"}}\n{\"apiVersion\":\"v1\",\"kind\":\"Secret\",\"metadata\":{\"name\":\"c\"}}\n",
+			want:  []string{"Service/a", "ConfigMap/b", "Secret/c"},
+		},
+		{
+			name:  "lists are expanded",
+			input: "{\"apiVersion\":\"v1\",\"kind\":\"List\",\"items\":[{\"apiVersion\":\"v1\",\"kind\":\"Service\",\"metadata\":{\"name\":\"a\"}},{\"apiVersion\":\"v1\",\"kind\":\"List\",\"items\":[{\"apiVersion\":\"v1\",\"kind\":\"ConfigMap\",\"metadata\":{\"name\":\"b\"}}]}]}",
+			want:  []string{"Service/a", "ConfigMap/b"},
+		},
+		{
+			name:  "typed list",
+			input: "apiVersion: v1\nkind: ConfigMapList\nitems:\n- apiVersion: v1\n  kind: ConfigMap\n  metadata:\n    name: b\n",
+			want:  []string{"ConfigMap/b"},
+		},
+		{
+			name:  "documents that are not objects are skipped",
+			input: "NOTES:\n1. Get the application URL\n---\napiVersion: v1\nkind: Service\nmetadata:\n  name: a\n---\nreplicas: 2\n",
+			want:  []string{"Service/a"},
+		},
+		{
+			name:  "long lines",
+			input: "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: b\ndata:\n  big: " + strings.Repeat("x", 1<<20) + "\n",
+			want:  []string{"ConfigMap/b"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			err := decodeManifests(strings.NewReader(tt.input), false, func(obj *unstructured.Unstructured) {
+				got = append(got, obj.GetKind()+"/"+obj.GetName())
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("decodeManifests() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// the objects of a JSON stream are passed on as they arrive, not once the stream ends
+func TestDecodeManifestsStreamsJSON(t *testing.T) {
+	r, w := io.Pipe()
+	decoded := make(chan string)
+	done := make(chan error)
+	go func() {
+		done <- decodeManifests(r, false, func(obj *unstructured.Unstructured) {
+			decoded <- obj.GetName()
+		})
+	}()
+
+	for _, name := range []string{"a", "b"} {
+		go w.Write([]byte(`{"apiVersion":"v1","kind":"ConfigMap","metadata":{"name":"` + name + `"}}` + "\n"))
+		select {
+		case got := <-decoded:
+			if got != name {
+				t.Fatalf("decoded %q, want %q", got, name)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("object %q was not decoded before the input ended", name)
+		}
+	}
+	w.Close()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSkipToManifests(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{name: "helm debug header", input: "install.go:214: [debug] CHART PATH: /tmp/chart\n\n---\napiVersion: v1\n", want: "---\napiVersion: v1\n"},
+		{name: "json", input: "  {\"kind\":\"List\"}\n---\n", want: "  {\"kind\":\"List\"}\n---\n"},
+		{name: "no separator", input: "apiVersion: v1\nkind: Service\n", want: "apiVersion: v1\nkind: Service\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(skipToManifests([]byte(tt.input))); got != tt.want {
+				t.Errorf("skipToManifests() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
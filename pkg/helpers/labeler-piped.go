@@ -9,59 +9,151 @@ import (
 	"os/exec"
 	"runtime"
 	"strings"
+	"sync"
 
 	c "github.com/clubanderson/labeler/pkg/common"
-	k "github.com/clubanderson/labeler/pkg/kube-helpers"
-	"gopkg.in/yaml.v3"
 )
 
+// pipedParams fills p with the flags, params and plugins of a piped run the way AliasRun does for the aliases, so
+// that 'helm ... | labeler -l x --l-bp-name=y' runs the same plugins as 'h ... -l x --l-bp-name=y'. args are the
+// labeler args, the command piped into labeler is read from the shell-init session when there is one.
+func pipedParams(args []string, p c.ParamsStruct) c.ParamsStruct {
+	getPluginNamesAndArgs(p)
+
+	// the flags cobra parsed are the arguments of the labeler and annotator plugins
+	if c.Flags.Debug {
+		p.Flags["l-debug"] = true
+	}
+	if c.Flags.Atomic {
+		p.Flags["l-atomic"] = true
+	}
+	if c.Flags.Wait != "" {
+		p.Params["l-wait"] = c.Flags.Wait
+	}
+	if c.Flags.Label != "" {
+		p.Params["label"] = c.Flags.Label
+		p.Params["labelKey"], p.Params["labelVal"], _ = strings.Cut(c.Flags.Label, "=")
+	}
+	if c.Flags.Annotation != "" {
+		p.Params["l-annotation"] = c.Flags.Annotation
+	}
+	if c.Flags.JournalConfigMap != "" {
+		p.Params["l-journal-configmap"] = c.Flags.JournalConfigMap
+	}
+
+	// with --file there is no command piped into labeler
+	producer, cmdFound, err := getOriginalCommandFromSession(p)
+	if err == nil && c.Flags.Filepath == "" {
+		parseArgs(producer, p)
+		if cmdFound == "helm" {
+			p.Flags["helm"] = true
+		} else {
+			p.Flags["kubectl"] = true
+		}
+		p.OriginalCmd = strings.Join(producer, " ")
+	}
+	// the plugin args (--l-bp-name=y, ...) that cobra left alone
+	parseArgs(append([]string{"labeler"}, args...), p)
+
+	if !(p.Flags["upgrade"] || p.Flags["install"] || p.Flags["apply"] || p.Flags["create"] || p.Flags["replace"]) {
+		// the piped objects are to be labeled whatever command printed them (helm template, kubectl get, a file)
+		p.Flags["apply"] = true
+	}
+
+	if p.Flags["l-debug"] {
+		log.Println("labeler.go: [debug] Flags:")
+		for flag, value := range p.Flags {
+			log.Printf("labeler.go: [debug] %s: %t\n", flag, value)
+		}
+		log.Println("\nlabeler.go: [debug] Params:")
+		for param, value := range p.Params {
+			log.Printf("labeler.go: [debug] %s: %s\n", param, value)
+		}
+		log.Println()
+	}
+
+	addNamespaceToResources(p)
+	return p
+}
+
 func DetectInput(p c.ParamsStruct) error {
-	var yamlData interface{}
+	out := os.Stdout
+	if c.Flags.Tee {
+		// stdout is the input of the next command in the pipeline, what labeler, plugins and the commands labeler
+		// runs print goes to stderr
+		os.Stdout = os.Stderr
+	}
+	p = pipedParams(os.Args[1:], p)
+	// after pipedParams, so that the cluster flags of the command line (--context, --server, ...) are known
+	p.ClientSet, p.RestConfig, p.DynamicClient = SwitchContext(p)
+
 	var buffer []string
 	c.RunResults.DidNotLabel = []string{}
 
-	if IsInputFromPipe() {
+	// --file wins over stdin, which is not a terminal in scripts, ssh sessions and CI runners without being piped to
+	if c.Flags.Filepath == "" && IsInputFromPipe() {
 		// if input is from a pipe, traverseinput and label the content of stdin
 		// log.Println("labeler.go: data is from pipe")
 		// // Read the input
-		scanner := bufio.NewScanner(os.Stdin)
-		var input []byte
-		for scanner.Scan() {
-			line := scanner.Text()
-			buffer = append(buffer, line)
-			if !isYAML(line) {
-				continue // Skip non-YAML lines
-			}
-			break
-		}
-
-		for scanner.Scan() {
-			input = append(input, scanner.Bytes()...)
-			input = append(input, '\n') // Append newline to separate lines
+		var stdin io.Reader = os.Stdin
+		if c.Flags.Tee {
+			// pass the input on unchanged so that labeler can sit in the middle of a pipeline
+			stdin = io.TeeReader(os.Stdin, out)
 		}
-
-		// Check for scanner error
-		if err := scanner.Err(); err != nil {
+		// lines are read whole whatever their length (e.g. the schema of a CRD on a single line)
+		reader := bufio.NewReader(stdin)
+		var firstLine string
+		var err error
+		buffer, firstLine, err = readToManifests(reader)
+		if err != nil {
 			log.Printf("labeler.go: error reading input: %v", err)
 			return nil
 		}
+		if c.Flags.Tee && firstLine == "" {
+			// the input has ended
+			out.Close()
+		}
+
+		if firstLine != "" && (producedHelmRelease(p) || isHelmRelease(append(buffer, firstLine))) {
+			// helm install|upgrade -o json|yaml prints the release, the objects are in the manifest helm recorded
+			rest, err := io.ReadAll(reader)
+			if c.Flags.Tee {
+				out.Close()
+			}
+			if err != nil {
+				log.Printf("labeler.go: error reading input: %v", err)
+				return nil
+			}
+			buffer = append(buffer, strings.Split(strings.TrimRight(firstLine+string(rest), "\r\n"), "\n")...)
+			return helmOrKubectl(buffer, p)
+		}
 
-		// Try parsing the input as YAML
-		if err := yaml.Unmarshal(input, &yamlData); err != nil {
-			_ = err
-			// log.Printf("labeler.go: warning: no YAML input was detected %v", err)
+		var manifests io.Reader = io.MultiReader(strings.NewReader(firstLine), reader)
+		if c.Flags.Tee {
+			// the next command in the pipeline (e.g. kubectl apply -f -) only starts applying once its input ends,
+			// which must not wait for labeling, as labeling may wait for the objects it creates (--l-wait), so the
+			// input is passed on at the speed it arrives and queued for labeling, which runs alongside
+			queue := newInputQueue()
+			copied := make(chan struct{})
+			go func(r io.Reader) {
+				_, err := io.Copy(queue, r)
+				out.Close()
+				queue.CloseWithError(err)
+				close(copied)
+			}(manifests)
+			// the input is passed on whole even if labeling fails
+			defer func() { <-copied }()
+			manifests = queue
 		}
 
-		// Check if YAML was provided
-		if yamlData != nil {
-			// log.Println("labeler.go: YAML data detected in stdin")
+		if firstLine != "" {
 			// Do something with the YAML data received - don't need to use history hack in this case - we got valid YAML input from template, --dry-run, or --debug
-			err := traverseHelmOutput(strings.NewReader(string(input)), p)
+			// the objects are labeled as they are decoded, the input is never held in memory as a whole
+			err := streamManifests(manifests, p)
 			if err != nil {
 				log.Println("labeler.go: error (traverseinput):", err)
 				return err
 			}
-			k.LabelResources(p)
 		} else {
 			// log.Println("labeler.go: no YAML data detected in stdin, will try to run again with YAML output")
 			// time to do it the hard way - many may not like this approach (history hack) - the other options above are more than sufficient for most people's use
@@ -70,58 +162,187 @@ func DetectInput(p c.ParamsStruct) error {
 	} else {
 		// ...otherwise get the file
 		log.Println("labeler.go: data is from file")
-		file, e := getFile()
+		manifests, e := getFile(p)
 		if e != nil {
+			log.Println(e)
 			return e
 		}
-		defer file.Close()
-		return helmOrKubectl(buffer, p)
+		err := streamManifests(bytes.NewReader(manifests), p)
+		if err != nil {
+			log.Println("labeler.go: error (traverseinput):", err)
+			return err
+		}
 	}
 
-	if len(c.RunResults.DidNotLabel) > 0 {
-		log.Printf("labeler.go: The following resources do not exist and can be labeled at a later time:\n\n")
-		for _, cmd := range c.RunResults.DidNotLabel {
-			log.Printf("%v", cmd)
+	c.RunResults.PrintSummary()
+	savePending(p)
+	exportPending(p)
+	saveJournal(p)
+	return nil
+}
+
+// readToManifests reads the lines before the first manifest, e.g. the output of helm install or kubectl apply that
+// helmOrKubectl works from, and returns them with the line the manifests start with (empty if there are none). The
+// manifests start at the start of a document, so that a document is never cut, e.g. a v1/List that starts with
+// apiVersion: and holds its items as a sequence.
+func readToManifests(reader *bufio.Reader) ([]string, string, error) {
+	var lines []string
+	for {
+		line, err := reader.ReadString('\n')
+		if isManifestStart(line) {
+			return lines, line, nil
+		}
+		if line != "" {
+			lines = append(lines, strings.TrimRight(line, "\r\n"))
+		}
+		if err == io.EOF {
+			return lines, "", nil
+		}
+		if err != nil {
+			return lines, "", err
 		}
 	}
-	return nil
+}
+
+// inputQueue is an in-memory pipe whose writes never block, it holds what was written and not read yet. It lets
+// --l-tee pass the input on while labeling, which may wait for objects (--l-wait), lags behind.
+type inputQueue struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	buf    bytes.Buffer
+	closed bool
+	err    error
+}
+
+func newInputQueue() *inputQueue {
+	q := &inputQueue{}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+func (q *inputQueue) Write(data []byte) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return 0, io.ErrClosedPipe
+	}
+	q.buf.Write(data)
+	q.cond.Signal()
+	return len(data), nil
+}
+
+// Read blocks until there is data or the queue is closed, then returns io.EOF or the error it was closed with
+func (q *inputQueue) Read(data []byte) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for q.buf.Len() == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if q.buf.Len() > 0 {
+		return q.buf.Read(data)
+	}
+	if q.err != nil {
+		return 0, q.err
+	}
+	return 0, io.EOF
+}
+
+// CloseWithError closes the queue, reads return err (io.EOF if nil) once the queued data is read
+func (q *inputQueue) CloseWithError(err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.err = err
+	q.cond.Broadcast()
 }
 
 func helmOrKubectl(input []string, p c.ParamsStruct) error {
-	originalCommand, cmdFound, err := getOriginalCommandFromHistory(p)
-	if err != nil {
-		log.Println("labeler.go: error (get history):", err)
-		// os.Exit(1)
+	// the shell-init hook records the exact command line, the history hack is only a fallback
+	originalArgs, cmdFound, err := getOriginalCommandFromSession(p)
+	fromHistory := err != nil
+	if fromHistory {
+		if p.Flags["l-debug"] {
+			log.Println("labeler.go: [debug] no shell-init session, falling back to shell history:", err)
+		}
+		var originalCommand string
+		originalCommand, cmdFound, err = getOriginalCommandFromHistory(p)
+		if err != nil {
+			log.Println("labeler.go: error (get history):", err)
+			// os.Exit(1)
+		}
+		originalArgs = strings.Fields(originalCommand)
+	}
+	if cmdFound == "" && isHelmRelease(input) {
+		// the command is not known, but the input is the release helm install, upgrade or rollback printed
+		cmdFound = "helm"
+		originalArgs = []string{"helm", "upgrade"}
+	}
+	p.OriginalCmd = strings.Join(originalArgs, " ")
+	if fromHistory {
+		// the command is only known now, its cluster flags may point labeler at another cluster (or conflict)
+		p.ClientSet, p.RestConfig, p.DynamicClient = SwitchContext(p)
 	}
 
 	// log.Printf("labeler.go: original command: %q\n\n", originalCommand)
 
 	if cmdFound == "helm" {
-		modifiedCommand := strings.Replace(originalCommand, "install", "template", 1)
-		modifiedCommandComponents := strings.Split(modifiedCommand, " ")[1:]
-		// log.Printf("labeler.go: modified command: %q\n", modifiedCommand)
-		// log.Printf("labeler.go: modified command components: %q\n", modifiedCommandComponents)
-		output, err := p.RunCmd("helm", modifiedCommandComponents, true)
-		if err != nil {
-			// log.Println("labeler.go: error (running helm):", err)
-			os.Exit(1)
+		var output []byte
+		switch helmSubcommand(originalArgs) {
+		case "install", "upgrade", "rollback":
+			// helm already ran, read the release it produced from its output
+			output, err = helmManifests(originalArgs, []byte(strings.Join(input, "\n")), p)
+			if err != nil {
+				log.Println("labeler.go: error (helm get manifest):", err)
+				return err
+			}
+		default:
+			output = runHelmInTemplateMode(originalArgs, p)
 		}
 
-		err = traverseHelmOutput(strings.NewReader(string(output)), p)
+		err = streamManifests(bytes.NewReader(skipToManifests(output)), p)
 		if err != nil {
 			log.Println("labeler.go: error (to traverseInput):", err)
 			return err
 		}
 
-		k.LabelResources(p)
-
+	} else if cmdFound == "kustomize" && kubectlWritesObjects(originalArgs, c.ParamsStruct{}) {
+		// the args alone tell whether kubectl applied the kustomization, p.Flags always has a write verb (see pipedParams)
+		err = traverseKustomizations(kustomizeDirs(originalArgs), p)
+		if err != nil {
+			log.Println("labeler.go: error (kustomize):", err)
+			return err
+		}
+		runPlugins(p)
 	} else if cmdFound == "kubectl" || cmdFound == "kustomize" {
 		traverseKubectlOutput(input, p)
-		k.LabelResources(p)
+		runPlugins(p)
 	}
+	c.RunResults.PrintSummary()
+	savePending(p)
+	exportPending(p)
+	saveJournal(p)
 	return nil
 }
 
+// helmTemplateArgs turns the args of a helm install or upgrade command into the args of the equivalent helm template command
+func helmTemplateArgs(args []string) []string {
+	var templateArgs []string
+	replaced := false
+	for _, arg := range args[1:] {
+		if !replaced && (arg == "install" || arg == "upgrade") {
+			templateArgs = append(templateArgs, "template")
+			replaced = true
+			continue
+		}
+		// helm template does not know upgrade --install
+		if replaced && (arg == "--install" || arg == "-i") {
+			continue
+		}
+		templateArgs = append(templateArgs, arg)
+	}
+	return templateArgs
+}
+
 func getOriginalCommandFromHistory(p c.ParamsStruct) (string, string, error) {
 	// TODO: this may not always be zsh, could be bash - should check if bash_history or zsh_history has "labeler" in it - that would tell us we have the right history file
 	cmd := exec.Command("bash")
@@ -0,0 +1,166 @@
+package helpers
+
+import (
+	"bufio"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const deploymentList = `apiVersion: v1
+items:
+- apiVersion: apps/v1
+  kind: Deployment
+  metadata:
+    name: a
+  spec:
+    template:
+      spec:
+        containers:
+        - name: app
+- apiVersion: apps/v1
+  kind: Deployment
+  metadata:
+    name: b
+kind: List
+metadata:
+  resourceVersion: ""
+`
+
+const deployment = `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: a
+spec:
+  template:
+    spec:
+      containers:
+      - name: app
+        args:
+        - --port=80
+`
+
+// the input is detected and decoded the way DetectInput does it
+func TestReadToManifests(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		wantLines []string
+		want      []string // kind/name of the decoded objects
+	}{
+		{name: "kubectl get -o yaml of several objects", input: deploymentList, want: []string{"Deployment/a", "Deployment/b"}},
+		{name: "kubectl get -o yaml of one object", input: deployment, want: []string{"Deployment/a"}},
+		{name: "kind first", input: "kind: ConfigMap\napiVersion: v1\nmetadata:\n  name: c\n", want: []string{"ConfigMap/c"}},
+		{
+			name:  "helm template",
+			input: "---\n# Source: chart/templates/svc.yaml\napiVersion: v1\nkind: Service\nmetadata:\n  name: s\n---\n" + deployment,
+			want:  []string{"Service/s", "Deployment/a"},
+		},
+		{
+			name:      "helm install --debug header",
+			input:     "install.go:214: [debug] CHART PATH: /tmp/chart\n\n---\n" + deployment,
+			wantLines: []string{"install.go:214: [debug] CHART PATH: /tmp/chart", ""},
+			want:      []string{"Deployment/a"},
+		},
+		{
+			name:  "json list",
+			input: `{"apiVersion":"v1","kind":"List","items":[{"apiVersion":"v1","kind":"ConfigMap","metadata":{"name":"c"}}]}`,
+			want:  []string{"ConfigMap/c"},
+		},
+		{
+			name:      "kubectl apply output",
+			input:     "deployment.apps/a configured\n- not a manifest\n  apiVersion: indented\n",
+			wantLines: []string{"deployment.apps/a configured", "- not a manifest", "  apiVersion: indented"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reader := bufio.NewReader(strings.NewReader(tt.input))
+			lines, firstLine, err := readToManifests(reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(lines, tt.wantLines) {
+				t.Errorf("readToManifests() lines = %q, want %q", lines, tt.wantLines)
+			}
+			if firstLine == "" {
+				if tt.want != nil {
+					t.Fatal("readToManifests() found no manifests")
+				}
+				return
+			}
+			var got []string
+			err = decodeManifests(io.MultiReader(strings.NewReader(firstLine), reader), false, func(obj *unstructured.Unstructured) {
+				got = append(got, obj.GetKind()+"/"+obj.GetName())
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("decoded %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInputQueue(t *testing.T) {
+	tests := []struct {
+		name     string
+		writes   []string
+		closeErr error
+		wantErr  error
+	}{
+		{name: "empty", wantErr: io.EOF},
+		{name: "writes in order", writes: []string{"apiVersion: v1\n", "kind: ConfigMap\n", "---\n"}, wantErr: io.EOF},
+		{name: "large write", writes: []string{strings.Repeat("x", 1<<20)}, wantErr: io.EOF},
+		{name: "read error", writes: []string{"kind: ConfigMap\n"}, closeErr: io.ErrUnexpectedEOF, wantErr: io.ErrUnexpectedEOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newInputQueue()
+			// writes do not wait for a reader
+			for _, w := range tt.writes {
+				if n, err := q.Write([]byte(w)); n != len(w) || err != nil {
+					t.Fatalf("Write() = %d, %v", n, err)
+				}
+			}
+			q.CloseWithError(tt.closeErr)
+			if _, err := q.Write([]byte("late")); err == nil {
+				t.Errorf("Write() after close did not fail")
+			}
+
+			var got strings.Builder
+			buf := make([]byte, 4096)
+			var err error
+			for err == nil {
+				var n int
+				n, err = q.Read(buf)
+				got.Write(buf[:n])
+			}
+			if want := strings.Join(tt.writes, ""); got.String() != want {
+				t.Errorf("read %d bytes, want %d", got.Len(), len(want))
+			}
+			if err != tt.wantErr {
+				t.Errorf("Read() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestInputQueueBlocks(t *testing.T) {
+	q := newInputQueue()
+	read := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(q)
+		read <- string(data)
+	}()
+	q.Write([]byte("kind: "))
+	q.Write([]byte("ConfigMap\n"))
+	q.CloseWithError(nil)
+	if got := <-read; got != "kind: ConfigMap\n" {
+		t.Errorf("ReadAll() = %q", got)
+	}
+}
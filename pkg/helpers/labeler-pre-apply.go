@@ -0,0 +1,84 @@
+package helpers
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+
+	c "github.com/clubanderson/labeler/pkg/common"
+	"github.com/clubanderson/labeler/pkg/transformer"
+)
+
+// injectBeforeApply renders the -f files and directories or the -k kustomization of a kubectl command, injects the
+// labels and annotations into the manifests, and returns the command rewritten to read them from stdin (-f -) with
+// the other flags intact, together with the labeled manifests (k apply ... --l-pre-apply)
+func injectBeforeApply(args []string, p c.ParamsStruct) ([]string, []byte, error) {
+	var files, kustomizations []string
+	recursive := false
+	rewritten := []string{}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "-f" || arg == "--filename" || arg == "-k" || arg == "--kustomize":
+			if i+1 >= len(args) {
+				return nil, nil, errors.New(arg + " requires a value")
+			}
+			if arg == "-k" || arg == "--kustomize" {
+				kustomizations = append(kustomizations, args[i+1])
+			} else {
+				files = append(files, args[i+1])
+			}
+			i++
+		case strings.HasPrefix(arg, "-f=") || strings.HasPrefix(arg, "--filename="):
+			files = append(files, arg[strings.Index(arg, "=")+1:])
+		case strings.HasPrefix(arg, "-k=") || strings.HasPrefix(arg, "--kustomize="):
+			kustomizations = append(kustomizations, arg[strings.Index(arg, "=")+1:])
+		case arg == "-R" || arg == "--recursive" || arg == "--recursive=true":
+			recursive = true
+		case arg == "--recursive=false":
+		default:
+			rewritten = append(rewritten, arg)
+		}
+	}
+	if len(files) == 0 && len(kustomizations) == 0 {
+		return nil, nil, errors.New("--l-pre-apply requires -f or -k")
+	}
+	for _, file := range files {
+		if strings.Contains(file, "://") {
+			return nil, nil, errors.New("--l-pre-apply cannot read URLs: " + file)
+		}
+	}
+
+	var manifests bytes.Buffer
+	if len(files) > 0 {
+		data, err := readManifestFiles(files, recursive)
+		if err != nil {
+			return nil, nil, err
+		}
+		appendDocument(&manifests, data)
+	}
+	for _, dir := range kustomizations {
+		data, err := renderKustomization(dir, p)
+		if err != nil {
+			return nil, nil, err
+		}
+		appendDocument(&manifests, data)
+	}
+
+	labels := map[string]string{}
+	if p.Params["labelKey"] != "" {
+		labels[p.Params["labelKey"]] = p.Params["labelVal"]
+	}
+	var labeled bytes.Buffer
+	err := transformer.Transform(&manifests, &labeled, transformer.OptionsStruct{
+		Labels:       labels,
+		Annotations:  c.KeyValues(p.Params["l-annotation"]),
+		PodTemplates: p.Flags["l-pod-template"],
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rewritten = append(rewritten, "-f", "-")
+	return rewritten, labeled.Bytes(), nil
+}
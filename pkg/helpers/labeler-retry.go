@@ -0,0 +1,128 @@
+package helpers
+
+import (
+	"fmt"
+	"log"
+
+	c "github.com/clubanderson/labeler/pkg/common"
+	q "github.com/clubanderson/labeler/pkg/deferred-queue"
+	k "github.com/clubanderson/labeler/pkg/kube-helpers"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// RetryRun applies the pending label and annotation operations for the current context that were saved by earlier runs.
+// Operations whose objects now exist are applied and dropped from the queue, the rest stay pending.
+func RetryRun(args []string, p c.ParamsStruct) error {
+	p.Flags = make(map[string]bool)
+	p.Params = make(map[string]string)
+	p.Resources = make(map[c.ResourceStruct][]byte)
+	parseArgs(args, p)
+
+	queue, err := q.Load(p.HomeDir)
+	if err != nil {
+		log.Println("labeler.go: error (loading pending queue):", err)
+		return err
+	}
+
+	context := currentContextName(p)
+	collections := queue.Contexts[context]
+	if len(collections) == 0 {
+		log.Printf("labeler.go: no pending operations for context %q\n", context)
+		return nil
+	}
+
+	p.ClientSet, p.RestConfig, p.DynamicClient = SwitchContext(p)
+	p = k.StartWait(p)
+
+	for collection, ops := range collections {
+		if p.Params["l-collection"] != "" && p.Params["l-collection"] != collection {
+			continue
+		}
+		var stillPending []c.PendingStruct
+		for _, op := range ops {
+			err := applyPending(op, p)
+			if err == nil {
+				continue
+			}
+			if !errors.IsNotFound(err) {
+				log.Printf("  🔴 failed to apply pending operation to %v/%v/%v %q in namespace %q: %v\n", op.Resource.Group, op.Resource.Version, op.Resource.Resource, op.Resource.ObjectName, op.Resource.Namespace, err)
+			}
+			stillPending = append(stillPending, op)
+		}
+		collections[collection] = stillPending
+	}
+
+	if err := queue.Save(p.HomeDir); err != nil {
+		log.Println("labeler.go: error (saving pending queue):", err)
+		return err
+	}
+	saveJournal(p)
+	printPending(queue.Contexts[context])
+	return nil
+}
+
+func applyPending(op c.PendingStruct, p c.ParamsStruct) error {
+	gvr := schema.GroupVersionResource{
+		Group:    op.Resource.Group,
+		Version:  op.Resource.Version,
+		Resource: op.Resource.Resource,
+	}
+	if len(op.Labels) > 0 {
+		if err := k.PatchMetadata("labels", op.Labels, op.Resource.Namespace, op.Resource.ObjectName, gvr, p); err != nil {
+			return err
+		}
+	}
+	if len(op.Annotations) > 0 {
+		if err := k.PatchMetadata("annotations", op.Annotations, op.Resource.Namespace, op.Resource.ObjectName, gvr, p); err != nil {
+			return err
+		}
+	}
+	log.Printf("  🏷️ applied pending labels %v and annotations %v to object %v/%v/%v %q in namespace %q\n", op.Labels, op.Annotations, gvr.Group, gvr.Version, gvr.Resource, op.Resource.ObjectName, op.Resource.Namespace)
+	return nil
+}
+
+func printPending(collections map[string][]c.PendingStruct) {
+	if len(collections) == 0 {
+		log.Println("labeler.go: no operations are pending")
+		return
+	}
+	log.Printf("\nlabeler.go: The following operations are still pending:\n\n")
+	for collection, ops := range collections {
+		log.Printf("  collection %q:\n", collection)
+		for _, op := range ops {
+			namespace := ""
+			if op.Resource.Namespace != "" {
+				namespace = fmt.Sprintf(" in namespace %q", op.Resource.Namespace)
+			}
+			log.Printf("    %v/%v/%v %q%v labels: %v annotations: %v\n", op.Resource.Group, op.Resource.Version, op.Resource.Resource, op.Resource.ObjectName, namespace, op.Labels, op.Annotations)
+		}
+	}
+}
+
+// savePending adds the operations deferred during this run to the persistent queue, so that 'labeler retry' can apply them later
+func savePending(p c.ParamsStruct) {
+	if len(c.RunResults.Pending) == 0 {
+		return
+	}
+	queue, err := q.Load(p.HomeDir)
+	if err != nil {
+		log.Println("labeler.go: error (loading pending queue):", err)
+		return
+	}
+	queue.Add(currentContextName(p), collectionName(p), c.RunResults.Pending)
+	if err := queue.Save(p.HomeDir); err != nil {
+		log.Println("labeler.go: error (saving pending queue):", err)
+		return
+	}
+	log.Printf("labeler.go: %d pending operations saved, run 'labeler retry' to apply them once the objects exist\n", len(c.RunResults.Pending))
+}
+
+// collectionName identifies the collection a run belongs to by the label that was applied
+func collectionName(p c.ParamsStruct) string {
+	if p.Params["labelKey"] != "" {
+		return p.Params["labelKey"] + "=" + p.Params["labelVal"]
+	}
+	return c.Flags.Label
+}
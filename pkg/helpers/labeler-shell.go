@@ -0,0 +1,201 @@
+package helpers
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	c "github.com/clubanderson/labeler/pkg/common"
+)
+
+// the shell hooks record every command line to a per-session file named by LABELER_SESSION_FILE, so that piped labeler
+// can find the exact command that produced its input. The hooks are installed with: eval "$(labeler shell-init bash)"
+// Command lines may hold tokens, so the sessions directory is only readable by its owner, and so are the files. The
+// bash hook runs the DEBUG and EXIT traps that were set before it, and records with builtins only, so that no process
+// is started for each command.
+const bashHook = `if [ -z "$__labeler_hooked" ]; then
+__labeler_hooked=1
+export LABELER_SESSION_FILE="${HOME}/.labeler/sessions/$$"
+(umask 077 && mkdir -p "${HOME}/.labeler/sessions" && chmod 700 "${HOME}/.labeler/sessions" && rm -f "$LABELER_SESSION_FILE" && : > "$LABELER_SESSION_FILE")
+__labeler_previous_trap() {
+  # $1 is a trap the way trap -p prints it, a trap command, which is run with trap redefined to keep the command
+  __labeler_previous=
+  trap() { __labeler_previous=$2; }
+  eval "$1"
+  unset -f trap
+}
+__labeler_nl='
+'
+__labeler_record=1
+__labeler_preexec() {
+  # the DEBUG trap runs before every simple command, record only the first one of each command line (history prints
+  # it with its number, which labeler drops)
+  [ "$__labeler_record" = 1 ] || return
+  __labeler_record=0
+  HISTTIMEFORMAT= builtin history 1 >| "$LABELER_SESSION_FILE"
+}
+# functions do not see the DEBUG trap, trap -p has to run here
+__labeler_previous_trap "$(trap -p DEBUG)"
+trap "${__labeler_previous:+$__labeler_previous$__labeler_nl}__labeler_preexec" DEBUG
+__labeler_previous_trap "$(trap -p EXIT)"
+trap "${__labeler_previous:+$__labeler_previous$__labeler_nl}"'rm -f "$LABELER_SESSION_FILE"' EXIT
+PROMPT_COMMAND="${PROMPT_COMMAND:+$PROMPT_COMMAND;}__labeler_record=1"
+fi
+`
+
+const zshHook = `export LABELER_SESSION_FILE="${HOME}/.labeler/sessions/$$"
+(umask 077 && mkdir -p "${HOME}/.labeler/sessions" && chmod 700 "${HOME}/.labeler/sessions" && rm -f "$LABELER_SESSION_FILE" && : > "$LABELER_SESSION_FILE")
+__labeler_preexec() {
+  print -r -- "$1" >| "$LABELER_SESSION_FILE"
+}
+__labeler_exit() {
+  rm -f "$LABELER_SESSION_FILE"
+}
+autoload -Uz add-zsh-hook
+add-zsh-hook preexec __labeler_preexec
+add-zsh-hook zshexit __labeler_exit
+`
+
+const fishHook = `set -gx LABELER_SESSION_FILE "$HOME/.labeler/sessions/$fish_pid"
+sh -c 'umask 077 && mkdir -p "$HOME/.labeler/sessions" && chmod 700 "$HOME/.labeler/sessions" && rm -f "$LABELER_SESSION_FILE" && : > "$LABELER_SESSION_FILE"'
+function __labeler_preexec --on-event fish_preexec
+  printf '%s\n' "$argv" > "$LABELER_SESSION_FILE"
+end
+function __labeler_exit --on-event fish_exit
+  rm -f "$LABELER_SESSION_FILE"
+end
+`
+
+// historyNumber is the number bash's history builtin prints before a command line
+var historyNumber = regexp.MustCompile(`^[0-9]+\*?\s+`)
+
+// ShellInitRun prints the hook for a shell (labeler shell-init bash|zsh|fish)
+func ShellInitRun(args []string, p c.ParamsStruct) error {
+	shell := ""
+	if len(args) > 1 {
+		shell = args[1]
+	} else {
+		shell = filepath.Base(os.Getenv("SHELL"))
+	}
+	hooks := map[string]string{"bash": bashHook, "zsh": zshHook, "fish": fishHook}
+	hook, ok := hooks[shell]
+	if !ok {
+		err := fmt.Errorf("unsupported shell %q, use bash, zsh or fish", shell)
+		log.Println("labeler.go:", err)
+		return err
+	}
+	_, err := os.Stdout.WriteString(hook)
+	return err
+}
+
+// getOriginalCommandFromSession returns the argv of the command that piped its output into labeler, as recorded by
+// the shell-init hook, and whether it was helm, kubectl or kustomize (kubectl -k)
+func getOriginalCommandFromSession(p c.ParamsStruct) ([]string, string, error) {
+	sessionFile := os.Getenv("LABELER_SESSION_FILE")
+	if sessionFile == "" {
+		return nil, "", fmt.Errorf("LABELER_SESSION_FILE is not set, add 'eval \"$(labeler shell-init <shell>)\"' to your shell rc file")
+	}
+	data, err := os.ReadFile(sessionFile)
+	if err != nil {
+		return nil, "", err
+	}
+	commandLine := historyNumber.ReplaceAllString(strings.TrimSpace(string(data)), "")
+	if p.Flags["l-debug"] {
+		log.Printf("labeler.go: [debug] command line from %v: %q\n", sessionFile, commandLine)
+	}
+
+	// the producer is the command piped into labeler, e.g. helm in 'helm install ... | labeler -l ...; helm uninstall ...'.
+	// A line without labeler is not the command line of this run, e.g. bash with HISTCONTROL=ignorespace does not
+	// record a command line that starts with a space and the file still holds the one before.
+	pipelines := splitPipelines(commandLine)
+	var producer []string
+	for _, pipeline := range pipelines {
+		for i, argv := range pipeline {
+			if i > 0 && len(argv) > 0 && filepath.Base(argv[0]) == "labeler" {
+				producer = pipeline[i-1]
+			}
+		}
+	}
+	if len(producer) == 0 {
+		return nil, "", fmt.Errorf("no command piped into labeler in %q", commandLine)
+	}
+
+	switch filepath.Base(producer[0]) {
+	case "helm", "h":
+		return producer, "helm", nil
+	case "kubectl", "k", "oc":
+		for _, arg := range producer {
+			if arg == "-k" || arg == "--kustomize" || strings.HasPrefix(arg, "-k=") || strings.HasPrefix(arg, "--kustomize=") {
+				return producer, "kustomize", nil
+			}
+		}
+		return producer, "kubectl", nil
+	}
+	return producer, "", fmt.Errorf("%q is not a helm or kubectl command", producer[0])
+}
+
+// splitPipelines splits a shell command line into its pipelines (separated by ;, && or ||) and each pipeline into the
+// argv of its commands, honoring quotes and backslash escapes
+func splitPipelines(commandLine string) [][][]string {
+	var pipelines [][][]string
+	var pipeline [][]string
+	var argv []string
+	var word strings.Builder
+	inWord := false
+	var quote rune
+
+	endWord := func() {
+		if inWord {
+			argv = append(argv, word.String())
+			word.Reset()
+			inWord = false
+		}
+	}
+	endPipeline := func() {
+		endWord()
+		pipeline = append(pipeline, argv)
+		pipelines = append(pipelines, pipeline)
+		pipeline, argv = nil, nil
+	}
+	runes := []rune(commandLine)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else if r == '\\' && quote == '"' && i+1 < len(runes) {
+				i++
+				word.WriteRune(runes[i])
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inWord = true
+		case r == '\\' && i+1 < len(runes):
+			i++
+			word.WriteRune(runes[i])
+			inWord = true
+		case r == ' ' || r == '\t' || r == '\n':
+			endWord()
+		case r == '|' && i+1 < len(runes) && runes[i+1] == '|', r == '&' && i+1 < len(runes) && runes[i+1] == '&':
+			i++
+			endPipeline()
+		case r == ';':
+			endPipeline()
+		case r == '|':
+			endWord()
+			pipeline = append(pipeline, argv)
+			argv = nil
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	endPipeline()
+	return pipelines
+}
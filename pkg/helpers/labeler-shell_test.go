@@ -0,0 +1,126 @@
+package helpers
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	c "github.com/clubanderson/labeler/pkg/common"
+)
+
+func TestSplitPipelines(t *testing.T) {
+	tests := []struct {
+		name        string
+		commandLine string
+		want        [][][]string
+	}{
+		{
+			name:        "single command",
+			commandLine: "helm template app ./chart",
+			want:        [][][]string{{{"helm", "template", "app", "./chart"}}},
+		},
+		{
+			name:        "pipeline",
+			commandLine: "helm template app ./chart | labeler -l app=x",
+			want:        [][][]string{{{"helm", "template", "app", "./chart"}, {"labeler", "-l", "app=x"}}},
+		},
+		{
+			name:        "pipelines",
+			commandLine: "helm install app ./chart | labeler -l app=x; helm uninstall app && kubectl get pods || true",
+			want: [][][]string{
+				{{"helm", "install", "app", "./chart"}, {"labeler", "-l", "app=x"}},
+				{{"helm", "uninstall", "app"}},
+				{{"kubectl", "get", "pods"}},
+				{{"true"}},
+			},
+		},
+		{
+			name:        "quotes",
+			commandLine: `kubectl annotate pod x 'note=a | b; c' "other=\"d\"" | labeler`,
+			want:        [][][]string{{{"kubectl", "annotate", "pod", "x", "note=a | b; c", `other="d"`}, {"labeler"}}},
+		},
+		{
+			name:        "empty quotes and escapes",
+			commandLine: `helm install app ./chart --set name='' --set path=a\ b`,
+			want:        [][][]string{{{"helm", "install", "app", "./chart", "--set", "name=", "--set", "path=a b"}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := splitPipelines(tt.commandLine); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("splitPipelines() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetOriginalCommandFromSession(t *testing.T) {
+	tests := []struct {
+		name     string
+		session  string
+		want     []string
+		wantFrom string
+		wantErr  bool
+	}{
+		{
+			name:     "zsh and fish",
+			session:  "helm template app ./chart | labeler -l app=x\n",
+			want:     []string{"helm", "template", "app", "./chart"},
+			wantFrom: "helm",
+		},
+		{
+			name:     "bash history number",
+			session:  "  512  kubectl apply -f app.yaml -o yaml | labeler -l app=x\n",
+			want:     []string{"kubectl", "apply", "-f", "app.yaml", "-o", "yaml"},
+			wantFrom: "kubectl",
+		},
+		{
+			name:     "bash history number of a modified entry",
+			session:  "  513* k apply -k overlay/ -o yaml | labeler -l app=x\n",
+			want:     []string{"k", "apply", "-k", "overlay/", "-o", "yaml"},
+			wantFrom: "kustomize",
+		},
+		{
+			name:     "producer after other commands",
+			session:  "cd app; helm template app ./chart | labeler -l app=x",
+			want:     []string{"helm", "template", "app", "./chart"},
+			wantFrom: "helm",
+		},
+		{
+			name:    "stale line without labeler",
+			session: "helm --kube-context=prod install app ./chart\n",
+			wantErr: true,
+		},
+		{
+			name:    "labeler not in a pipeline",
+			session: "labeler -f app.yaml -l app=x\n",
+			wantErr: true,
+		},
+		{
+			name:    "not helm or kubectl",
+			session: "cat app.yaml | labeler -l app=x",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sessionFile := filepath.Join(t.TempDir(), "session")
+			if err := os.WriteFile(sessionFile, []byte(tt.session), 0600); err != nil {
+				t.Fatal(err)
+			}
+			t.Setenv("LABELER_SESSION_FILE", sessionFile)
+
+			got, from, err := getOriginalCommandFromSession(c.ParamsStruct{Flags: map[string]bool{}})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("getOriginalCommandFromSession() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) || from != tt.wantFrom {
+				t.Errorf("getOriginalCommandFromSession() = %q, %q, want %q, %q", got, from, tt.want, tt.wantFrom)
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package helpers
+
+import (
+	"fmt"
+	"io"
+	"log"
+
+	c "github.com/clubanderson/labeler/pkg/common"
+	k "github.com/clubanderson/labeler/pkg/kube-helpers"
+	"gopkg.in/yaml.v3"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// streamManifests runs the plugins on the objects of the manifests in r as they are decoded, without holding the
+// input in memory: each object is resolved against the cluster and handed to the plugins on its own, without its
+// manifest. Buffered plugins (bufferedPlugins, and all plugins with --l-atomic) run once at the end with every object
+// and its manifest in p.Resources.
+func streamManifests(r io.Reader, p c.ParamsStruct) error {
+	p = k.StartWait(p)
+	mapper, err := k.RESTMapper(p)
+	if err != nil {
+		return err
+	}
+	defaultNamespace := commandNamespace(p)
+
+	var streamed, buffered []string
+	for _, pkey := range triggeredPlugins(p) {
+		// an atomic run has to check all patches before it applies any of them
+		if bufferedPlugins[pkey] || p.Flags["l-atomic"] {
+			buffered = append(buffered, pkey)
+		} else {
+			streamed = append(streamed, pkey)
+		}
+	}
+	for _, pkey := range streamed {
+		log.Printf("\nlabeler plugin: %q:\n\n", pkey)
+	}
+
+	// the objects added before the input was read (the -n namespace)
+	if len(p.Resources) > 0 {
+		for _, pkey := range streamed {
+			callPlugin(pkey, p)
+		}
+	}
+
+	add := func(runtimeObj *unstructured.Unstructured) error {
+		resource, err := manifestResource(runtimeObj, mapper, defaultNamespace)
+		if err != nil {
+			return err
+		}
+		if len(buffered) > 0 {
+			yamlBytes, err := yaml.Marshal(runtimeObj.Object)
+			if err != nil {
+				log.Printf("labeler.go: error marshaling YAML: %v\n", err)
+				return nil
+			}
+			p.Resources[resource] = yamlBytes
+		}
+		if len(streamed) > 0 {
+			object := p
+			object.Resources = map[c.ResourceStruct][]byte{resource: nil}
+			for _, pkey := range streamed {
+				callPlugin(pkey, object)
+			}
+		}
+		return nil
+	}
+
+	var crds []string
+	var unmapped []*unstructured.Unstructured
+	err = decodeManifests(r, p.Flags["l-debug"], func(runtimeObj *unstructured.Unstructured) {
+		if k.IsCRD(runtimeObj.GroupVersionKind()) {
+			crds = append(crds, runtimeObj.GetName())
+		}
+		if err := add(runtimeObj); err != nil {
+			if p.Flags["l-debug"] {
+				gvk := runtimeObj.GroupVersionKind()
+				log.Printf("labeler.go: error getting gvr from gvk for %v/%v/%v: %v\n", gvk.Group, gvk.Version, gvk.Kind, err)
+			}
+			// only the objects of kinds the cluster does not know yet are kept until the end
+			unmapped = append(unmapped, runtimeObj)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(unmapped) > 0 {
+		// the input may define the CRDs of the objects that could not be mapped, once they are established the mapper
+		// has to discover them
+		if len(crds) > 0 {
+			k.WaitForCRDs(crds, p)
+			mapper.Reset()
+		}
+		for _, runtimeObj := range unmapped {
+			if err := add(runtimeObj); err != nil {
+				gvk := runtimeObj.GroupVersionKind()
+				failure := fmt.Sprintf("%v/%v/%v %q in namespace %q: unknown kind, is its CRD installed? (%v)\n", gvk.Group, gvk.Version, gvk.Kind, runtimeObj.GetName(), runtimeObj.GetNamespace(), err)
+				c.RunResults.FailedToLabel = append(c.RunResults.FailedToLabel, failure)
+			}
+		}
+	}
+
+	for _, pkey := range buffered {
+		log.Printf("\nlabeler plugin: %q:\n\n", pkey)
+		callPlugin(pkey, p)
+	}
+	return nil
+}
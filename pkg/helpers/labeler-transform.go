@@ -0,0 +1,178 @@
+package helpers
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	c "github.com/clubanderson/labeler/pkg/common"
+	"github.com/clubanderson/labeler/pkg/transformer"
+)
+
+// TransformRun injects labels and annotations into the manifests read from stdin or -f files and writes them to
+// stdout, without accessing a cluster (labeler transform -l key=value --l-annotation=key=value [--l-pod-template]).
+func TransformRun(args []string, p c.ParamsStruct) error {
+	p.Flags = make(map[string]bool)
+	p.Params = make(map[string]string)
+	parseArgs(args, p)
+
+	labels, annotations := metadataFromArgs(args)
+	if len(labels) == 0 && len(annotations) == 0 {
+		log.Println("labeler.go: no label or annotation provided")
+		os.Exit(1)
+	}
+
+	var input io.Reader = os.Stdin
+	if files := fileArgs(args); len(files) > 0 {
+		manifests, err := readManifestFiles(files, p.Flags["R"] || p.Flags["recursive"])
+		if err != nil {
+			log.Println("labeler.go: error (reading files):", err)
+			os.Exit(1)
+		}
+		input = bytes.NewReader(manifests)
+	}
+
+	err := transformer.Transform(input, os.Stdout, transformer.OptionsStruct{
+		Labels:       labels,
+		Annotations:  annotations,
+		PodTemplates: p.Flags["l-pod-template"],
+	})
+	if err != nil {
+		log.Println("labeler.go: error (transform):", err)
+		os.Exit(1)
+	}
+	return nil
+}
+
+// KRMRun runs labeler as a KRM function for kustomize transformers and kpt pipelines: a ResourceList is read from
+// stdin and written to stdout with its items labeled and annotated as its functionConfig says (labeler krm)
+func KRMRun(args []string, p c.ParamsStruct) error {
+	err := transformer.RunResourceList(os.Stdin, os.Stdout)
+	if err != nil {
+		log.Println("labeler.go: error (krm function):", err)
+		os.Exit(1)
+	}
+	return nil
+}
+
+// metadataFromArgs returns the labels (-l, --label) and annotations (--annotation, --l-annotation) given on a command line
+func metadataFromArgs(args []string) (map[string]string, map[string]string) {
+	labels := map[string]string{}
+	annotations := map[string]string{}
+	for i, arg := range args {
+		value, hasValue := "", false
+		name := arg
+		if strings.HasPrefix(arg, "-") && strings.Contains(arg, "=") {
+			parts := strings.SplitN(arg, "=", 2)
+			name, value, hasValue = parts[0], parts[1], true
+		} else if i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+			value, hasValue = args[i+1], true
+		}
+		if !hasValue {
+			continue
+		}
+		switch name {
+		case "-l", "--label":
+			for key, val := range c.KeyValues(value) {
+				labels[key] = val
+			}
+		case "--annotation", "--l-annotation":
+			for key, val := range c.KeyValues(value) {
+				annotations[key] = val
+			}
+		}
+	}
+	if c.Flags.Label != "" {
+		for key, val := range c.KeyValues(c.Flags.Label) {
+			labels[key] = val
+		}
+	}
+	if c.Flags.Annotation != "" {
+		for key, val := range c.KeyValues(c.Flags.Annotation) {
+			annotations[key] = val
+		}
+	}
+	return labels, annotations
+}
+
+// fileArgs returns every path given with -f, --filename or --file
+func fileArgs(args []string) []string {
+	var files []string
+	for i, arg := range args {
+		for _, name := range []string{"-f", "--filename", "--file"} {
+			if arg == name && i+1 < len(args) {
+				files = append(files, args[i+1])
+			} else if strings.HasPrefix(arg, name+"=") {
+				files = append(files, strings.TrimPrefix(arg, name+"="))
+			}
+		}
+	}
+	return files
+}
+
+// readManifestFiles concatenates the manifests in the given files and directories into a single YAML stream.
+// Directories are read one level deep unless recursive is set, like kubectl apply -f [-R].
+func readManifestFiles(paths []string, recursive bool) ([]byte, error) {
+	var out bytes.Buffer
+	for _, path := range paths {
+		if path == "-" {
+			data, err := io.ReadAll(os.Stdin)
+			if err != nil {
+				return nil, err
+			}
+			appendDocument(&out, data)
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return nil, err
+			}
+			appendDocument(&out, data)
+			continue
+		}
+		err = filepath.WalkDir(path, func(file string, d os.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				if file != path && !recursive {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			switch strings.ToLower(filepath.Ext(file)) {
+			case ".yaml", ".yml", ".json":
+			default:
+				return nil
+			}
+			data, err := os.ReadFile(file)
+			if err != nil {
+				return err
+			}
+			appendDocument(&out, data)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return out.Bytes(), nil
+}
+
+func appendDocument(out *bytes.Buffer, data []byte) {
+	if out.Len() > 0 {
+		out.WriteString("---\n")
+	}
+	out.Write(data)
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		out.WriteByte('\n')
+	}
+}
@@ -0,0 +1,182 @@
+package helpers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	c "github.com/clubanderson/labeler/pkg/common"
+	k "github.com/clubanderson/labeler/pkg/kube-helpers"
+	undoJournal "github.com/clubanderson/labeler/pkg/undo-journal"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// UndoRun restores the labels and annotations changed by a run (the latest run for the current context if no run ID
+// is given). Objects whose values were changed by someone else since the run are skipped with a warning, unless --l-force is set.
+// The journal records which changes were restored, undoing the run again only retries the ones that were skipped.
+func UndoRun(args []string, p c.ParamsStruct) error {
+	p.Flags = make(map[string]bool)
+	p.Params = make(map[string]string)
+	p.Resources = make(map[c.ResourceStruct][]byte)
+	parseArgs(args, p)
+
+	runID := ""
+	if len(args) > 1 && !strings.HasPrefix(args[1], "-") {
+		runID = args[1]
+	}
+
+	p.ClientSet, p.RestConfig, p.DynamicClient = SwitchContext(p)
+	contextName := currentContextName(p)
+
+	entry, err := loadJournalEntry(runID, contextName, p)
+	if err != nil {
+		log.Println("labeler.go: error (loading journal):", err)
+		return err
+	}
+	if entry.Undone {
+		err := fmt.Errorf("run %q has already been undone", entry.RunID)
+		log.Println("labeler.go:", err)
+		return err
+	}
+	if entry.Context != contextName {
+		err := fmt.Errorf("run %q was recorded against context %q, not %q", entry.RunID, entry.Context, contextName)
+		log.Println("labeler.go:", err)
+		return err
+	}
+
+	log.Printf("labeler.go: undoing run %q (%v)\n", entry.RunID, entry.Command)
+	skipped, restored := restoreChanges(&entry, p)
+	if skipped > 0 {
+		log.Printf("\nlabeler.go: %d changes were not restored, run 'labeler undo %v --l-force' to restore them anyway\n", skipped, entry.RunID)
+	}
+	if restored == 0 {
+		return nil
+	}
+	if err := undoJournal.Save(p.HomeDir, entry); err != nil {
+		log.Println("labeler.go: error (saving journal):", err)
+	}
+	if ns, name := journalConfigMap(p); name != "" {
+		if err := undoJournal.SaveToConfigMap(p.ClientSet, ns, name, entry); err != nil {
+			log.Println("labeler.go: error (saving journal to configmap):", err)
+		}
+	}
+	return nil
+}
+
+// restoreChanges restores the changes of a run that were not restored yet and marks them in the entry. Changes whose
+// values were changed since the run are skipped unless --l-force is set.
+func restoreChanges(entry *undoJournal.EntryStruct, p c.ParamsStruct) (int, int) {
+	skipped, restored := 0, 0
+	// restore in reverse order, so that a key changed twice in a run ends up with its original value
+	for i := len(entry.Changes) - 1; i >= 0; i-- {
+		change := entry.Changes[i]
+		if change.Restored {
+			continue
+		}
+		r := change.Resource
+		gvr := schema.GroupVersionResource{Group: r.Group, Version: r.Version, Resource: r.Resource}
+
+		current, exists, err := currentMetadataValue(change, gvr, p)
+		if err != nil {
+			log.Printf("  🔴 could not read %v/%v/%v %q in namespace %q: %v\n", gvr.Group, gvr.Version, gvr.Resource, r.ObjectName, r.Namespace, err)
+			skipped++
+			continue
+		}
+		if (!exists || current != change.After) && !p.Flags["l-force"] {
+			log.Printf("  🟡 %v %q on %v/%v/%v %q in namespace %q was changed to %q since the run, skipping (use --l-force to restore anyway)\n", change.Field, change.Key, gvr.Group, gvr.Version, gvr.Resource, r.ObjectName, r.Namespace, current)
+			skipped++
+			continue
+		}
+
+		if err := k.RestoreChange(change, p); err != nil {
+			log.Printf("  🔴 failed to restore %v %q on %v/%v/%v %q in namespace %q: %v\n", change.Field, change.Key, gvr.Group, gvr.Version, gvr.Resource, r.ObjectName, r.Namespace, err)
+			skipped++
+			continue
+		}
+		entry.MarkRestored(i)
+		restored++
+		if change.Before == nil {
+			log.Printf("  ↩️  removed %v %q from %v/%v/%v %q in namespace %q\n", change.Field, change.Key, gvr.Group, gvr.Version, gvr.Resource, r.ObjectName, r.Namespace)
+		} else {
+			log.Printf("  ↩️  restored %v %v=%v on %v/%v/%v %q in namespace %q\n", change.Field, change.Key, *change.Before, gvr.Group, gvr.Version, gvr.Resource, r.ObjectName, r.Namespace)
+		}
+	}
+	return skipped, restored
+}
+
+func loadJournalEntry(runID, contextName string, p c.ParamsStruct) (undoJournal.EntryStruct, error) {
+	var entry undoJournal.EntryStruct
+	var err error
+	if runID != "" {
+		entry, err = undoJournal.Load(p.HomeDir, runID)
+	} else {
+		entry, err = undoJournal.Latest(p.HomeDir, contextName)
+	}
+	if err == nil {
+		return entry, nil
+	}
+	// fall back to the in-cluster journal, e.g. when the run was made from another machine
+	if ns, name := journalConfigMap(p); name != "" {
+		return undoJournal.LoadFromConfigMap(p.ClientSet, ns, name, runID, contextName)
+	}
+	return entry, err
+}
+
+func currentMetadataValue(change undoJournal.ChangeStruct, gvr schema.GroupVersionResource, p c.ParamsStruct) (string, bool, error) {
+	var obj *unstructured.Unstructured
+	var err error
+	if change.Resource.Namespace == "" {
+		obj, err = p.DynamicClient.Resource(gvr).Get(context.TODO(), change.Resource.ObjectName, metav1.GetOptions{})
+	} else {
+		obj, err = p.DynamicClient.Resource(gvr).Namespace(change.Resource.Namespace).Get(context.TODO(), change.Resource.ObjectName, metav1.GetOptions{})
+	}
+	if err != nil {
+		return "", false, err
+	}
+	values := obj.GetLabels()
+	if change.Field == "annotations" {
+		values = obj.GetAnnotations()
+	}
+	val, ok := values[change.Key]
+	return val, ok, nil
+}
+
+// journalConfigMap returns the namespace and name given with --l-journal-configmap=namespace/name
+func journalConfigMap(p c.ParamsStruct) (string, string) {
+	ref := p.Params["l-journal-configmap"]
+	if ref == "" {
+		return "", ""
+	}
+	if !strings.Contains(ref, "/") {
+		return "default", ref
+	}
+	parts := strings.SplitN(ref, "/", 2)
+	return parts[0], parts[1]
+}
+
+// saveJournal stores the journal of this run locally, and in a configmap if --l-journal-configmap is set
+func saveJournal(p c.ParamsStruct) {
+	command := p.OriginalCmd
+	if command == "" {
+		command = strings.Join(os.Args, " ")
+	}
+	entry, changed := undoJournal.Finish(currentContextName(p), command)
+	if !changed {
+		return
+	}
+	if err := undoJournal.Save(p.HomeDir, entry); err != nil {
+		log.Println("labeler.go: error (saving journal):", err)
+		return
+	}
+	if ns, name := journalConfigMap(p); name != "" {
+		if err := undoJournal.SaveToConfigMap(p.ClientSet, ns, name, entry); err != nil {
+			log.Println("labeler.go: error (saving journal to configmap):", err)
+		}
+	}
+	log.Printf("labeler.go: run %q recorded, revert it with 'labeler undo %v'\n", entry.RunID, entry.RunID)
+}
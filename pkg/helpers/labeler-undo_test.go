@@ -0,0 +1,125 @@
+package helpers
+
+import (
+	"reflect"
+	"testing"
+
+	c "github.com/clubanderson/labeler/pkg/common"
+	undoJournal "github.com/clubanderson/labeler/pkg/undo-journal"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+func TestRestoreChanges(t *testing.T) {
+	resource := c.ResourceStruct{Version: "v1", Resource: "configmaps", Namespace: "default", ObjectName: "cm"}
+	old, mid := "old", "mid"
+	tests := []struct {
+		name         string
+		labels       map[string]string
+		changes      []undoJournal.ChangeStruct
+		force        bool
+		wantLabels   map[string]string
+		wantSkipped  int
+		wantRestored int
+		wantUndone   bool
+	}{
+		{
+			name:         "restored",
+			labels:       map[string]string{"app": "new"},
+			changes:      []undoJournal.ChangeStruct{{Resource: resource, Field: "labels", Key: "app", Before: &old, After: "new"}},
+			wantLabels:   map[string]string{"app": "old"},
+			wantRestored: 1,
+			wantUndone:   true,
+		},
+		{
+			name:         "added key removed",
+			labels:       map[string]string{"app": "new", "tier": "web"},
+			changes:      []undoJournal.ChangeStruct{{Resource: resource, Field: "labels", Key: "app", After: "new"}},
+			wantLabels:   map[string]string{"tier": "web"},
+			wantRestored: 1,
+			wantUndone:   true,
+		},
+		{
+			name:        "changed since the run",
+			labels:      map[string]string{"app": "other"},
+			changes:     []undoJournal.ChangeStruct{{Resource: resource, Field: "labels", Key: "app", Before: &old, After: "new"}},
+			wantLabels:  map[string]string{"app": "other"},
+			wantSkipped: 1,
+		},
+		{
+			name:        "removed since the run",
+			labels:      map[string]string{"tier": "web"},
+			changes:     []undoJournal.ChangeStruct{{Resource: resource, Field: "labels", Key: "app", Before: &old, After: "new"}},
+			wantLabels:  map[string]string{"tier": "web"},
+			wantSkipped: 1,
+		},
+		{
+			name:         "changed since the run with --l-force",
+			labels:       map[string]string{"app": "other"},
+			changes:      []undoJournal.ChangeStruct{{Resource: resource, Field: "labels", Key: "app", Before: &old, After: "new"}},
+			force:        true,
+			wantLabels:   map[string]string{"app": "old"},
+			wantRestored: 1,
+			wantUndone:   true,
+		},
+		{
+			name:   "key changed twice",
+			labels: map[string]string{"app": "new"},
+			changes: []undoJournal.ChangeStruct{
+				{Resource: resource, Field: "labels", Key: "app", Before: &old, After: "mid"},
+				{Resource: resource, Field: "labels", Key: "app", Before: &mid, After: "new"},
+			},
+			wantLabels:   map[string]string{"app": "old"},
+			wantRestored: 2,
+			wantUndone:   true,
+		},
+		{
+			name:   "restored change not retried",
+			labels: map[string]string{"app": "other", "tier": "db"},
+			changes: []undoJournal.ChangeStruct{
+				{Resource: resource, Field: "labels", Key: "app", Before: &old, After: "new", Restored: true},
+				{Resource: resource, Field: "labels", Key: "tier", After: "db"},
+			},
+			wantLabels:   map[string]string{"app": "other"},
+			wantRestored: 1,
+			wantUndone:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			obj := &unstructured.Unstructured{}
+			obj.SetAPIVersion("v1")
+			obj.SetKind("ConfigMap")
+			obj.SetNamespace(resource.Namespace)
+			obj.SetName(resource.ObjectName)
+			obj.SetLabels(tt.labels)
+			dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), obj)
+			p := c.ParamsStruct{
+				Flags:         map[string]bool{"l-force": tt.force},
+				Params:        map[string]string{},
+				DynamicClient: dynamicClient,
+			}
+
+			entry := undoJournal.EntryStruct{RunID: "run", Changes: tt.changes}
+			skipped, restored := restoreChanges(&entry, p)
+			if skipped != tt.wantSkipped || restored != tt.wantRestored {
+				t.Errorf("restoreChanges() = %d skipped, %d restored, want %d, %d", skipped, restored, tt.wantSkipped, tt.wantRestored)
+			}
+			if entry.Undone != tt.wantUndone {
+				t.Errorf("entry.Undone = %v, want %v", entry.Undone, tt.wantUndone)
+			}
+
+			gvr := schema.GroupVersionResource{Version: resource.Version, Resource: resource.Resource}
+			got, err := dynamicClient.Tracker().Get(gvr, resource.Namespace, resource.ObjectName)
+			if err != nil {
+				t.Fatalf("get: %v", err)
+			}
+			if labels := got.(*unstructured.Unstructured).GetLabels(); !reflect.DeepEqual(labels, tt.wantLabels) {
+				t.Errorf("labels = %v, want %v", labels, tt.wantLabels)
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package kubeHelpers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	c "github.com/clubanderson/labeler/pkg/common"
+	undoJournal "github.com/clubanderson/labeler/pkg/undo-journal"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// ApplyAtomic applies labels and annotations to all resources as a single unit (--l-atomic). Every patch is first
+// checked for permission and validated with a server-side dry run, nothing is changed if any check fails. If a real
+// patch fails, the patches already applied are rolled back.
+func ApplyAtomic(resources []c.ResourceStruct, labels, annotations map[string]string, p c.ParamsStruct) error {
+	metadata := map[string]interface{}{}
+	if len(labels) > 0 {
+		metadata["labels"] = labels
+	}
+	if len(annotations) > 0 {
+		metadata["annotations"] = annotations
+	}
+	if len(metadata) == 0 || len(resources) == 0 {
+		return nil
+	}
+	patch, err := json.Marshal(map[string]interface{}{"metadata": metadata})
+	if err != nil {
+		return err
+	}
+
+	var failures []string
+	for _, r := range resources {
+		gvr := schema.GroupVersionResource{Group: r.Group, Version: r.Version, Resource: r.Resource}
+		if err := checkPatch(r, gvr, patch, p); err != nil {
+			failures = append(failures, fmt.Sprintf("%v/%v/%v %q in namespace %q: %v\n", gvr.Group, gvr.Version, gvr.Resource, r.ObjectName, r.Namespace, err))
+		}
+	}
+	if len(failures) > 0 {
+		log.Printf("  🔴 atomic labeling aborted, no objects were changed. The following objects failed the checks:\n\n")
+		for _, failure := range failures {
+			log.Printf("%v", failure)
+		}
+		return fmt.Errorf("%d of %d objects failed the atomic labeling checks", len(failures), len(resources))
+	}
+
+	mark := undoJournal.Mark()
+	for _, r := range resources {
+		gvr := schema.GroupVersionResource{Group: r.Group, Version: r.Version, Resource: r.Resource}
+		var err error
+		if len(labels) > 0 {
+			err = PatchMetadata("labels", labels, r.Namespace, r.ObjectName, gvr, p)
+		}
+		if err == nil && len(annotations) > 0 {
+			err = PatchMetadata("annotations", annotations, r.Namespace, r.ObjectName, gvr, p)
+		}
+		if err != nil {
+			log.Printf("  🔴 atomic labeling failed on %v/%v/%v %q in namespace %q: %v\n", gvr.Group, gvr.Version, gvr.Resource, r.ObjectName, r.Namespace, err)
+			rollback(mark, p)
+			return fmt.Errorf("atomic labeling failed on %v/%v/%v %q in namespace %q and was rolled back: %v", gvr.Group, gvr.Version, gvr.Resource, r.ObjectName, r.Namespace, err)
+		}
+	}
+	log.Printf("  🏷️ atomically labeled %d objects with labels %v and annotations %v\n", len(resources), labels, annotations)
+	return nil
+}
+
+// checkPatch verifies that the caller may patch the object and that the server accepts the patch
+func checkPatch(r c.ResourceStruct, gvr schema.GroupVersionResource, patch []byte, p c.ParamsStruct) error {
+	review := &authorizationv1.SelfSubjectAccessReview{
+		Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Namespace: r.Namespace,
+				Verb:      "patch",
+				Group:     gvr.Group,
+				Version:   gvr.Version,
+				Resource:  gvr.Resource,
+				Name:      r.ObjectName,
+			},
+		},
+	}
+	result, err := p.ClientSet.AuthorizationV1().SelfSubjectAccessReviews().Create(context.TODO(), review, metav1.CreateOptions{})
+	if err != nil {
+		return err
+	}
+	if !result.Status.Allowed {
+		return fmt.Errorf("patch is not allowed: %v", result.Status.Reason)
+	}
+
+	dryRun := metav1.PatchOptions{DryRun: []string{metav1.DryRunAll}}
+	return retryNotFound(r.Namespace, r.ObjectName, gvr, p, func() error {
+		var err error
+		if r.Namespace == "" {
+			_, err = p.DynamicClient.Resource(gvr).Patch(context.TODO(), r.ObjectName, types.MergePatchType, patch, dryRun)
+		} else {
+			_, err = p.DynamicClient.Resource(gvr).Namespace(r.Namespace).Patch(context.TODO(), r.ObjectName, types.MergePatchType, patch, dryRun)
+		}
+		return err
+	})
+}
+
+// rollback restores the values replaced since a journal mark and drops those changes from the journal
+func rollback(mark int, p c.ParamsStruct) {
+	changes := undoJournal.Since(mark)
+	for i := len(changes) - 1; i >= 0; i-- {
+		change := changes[i]
+		r := change.Resource
+		if err := RestoreChange(change, p); err != nil {
+			log.Printf("  🔴 failed to roll back %v %q on %v/%v/%v %q in namespace %q: %v\n", change.Field, change.Key, r.Group, r.Version, r.Resource, r.ObjectName, r.Namespace, err)
+			continue
+		}
+		log.Printf("  ↩️  rolled back %v %q on %v/%v/%v %q in namespace %q\n", change.Field, change.Key, r.Group, r.Version, r.Resource, r.ObjectName, r.Namespace)
+	}
+	undoJournal.Truncate(mark)
+}
+
+// RestoreChange sets a label or annotation back to the value it had before a change, removing it if it did not exist
+func RestoreChange(change undoJournal.ChangeStruct, p c.ParamsStruct) error {
+	r := change.Resource
+	gvr := schema.GroupVersionResource{Group: r.Group, Version: r.Version, Resource: r.Resource}
+	var before interface{}
+	if change.Before != nil {
+		before = *change.Before
+	}
+	// a null value removes the key in a merge patch
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			change.Field: map[string]interface{}{change.Key: before},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	return PatchObject(r.Namespace, r.ObjectName, gvr, patch, p)
+}
@@ -0,0 +1,126 @@
+package kubeHelpers
+
+import (
+	"fmt"
+	"testing"
+
+	c "github.com/clubanderson/labeler/pkg/common"
+	undoJournal "github.com/clubanderson/labeler/pkg/undo-journal"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+var configMapsGVR = schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}
+
+func newConfigMap(name string, labels map[string]string) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion("v1")
+	obj.SetKind("ConfigMap")
+	obj.SetNamespace("default")
+	obj.SetName(name)
+	obj.SetLabels(labels)
+	return obj
+}
+
+// atomicParams returns params with fake clients. The fake dynamic client ignores the dry-run option, so the first
+// dryRuns patches only return the object, failing for failDryRun. The failPatch-th real patch fails (1-based).
+func atomicParams(objs []runtime.Object, denied, failDryRun string, dryRuns, failPatch int) (c.ParamsStruct, *dynamicfake.FakeDynamicClient) {
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), objs...)
+	patches := 0
+	dynamicClient.PrependReactor("patch", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		patch := action.(k8stesting.PatchAction)
+		patches++
+		if patches <= dryRuns {
+			if patch.GetName() == failDryRun {
+				return true, nil, fmt.Errorf("admission webhook denied the request")
+			}
+			obj, err := dynamicClient.Tracker().Get(patch.GetResource(), patch.GetNamespace(), patch.GetName())
+			return true, obj, err
+		}
+		if patches-dryRuns == failPatch {
+			return true, nil, fmt.Errorf("the object has been modified")
+		}
+		return false, nil, nil
+	})
+
+	clientSet := kubefake.NewSimpleClientset()
+	clientSet.PrependReactor("create", "selfsubjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SelfSubjectAccessReview)
+		review.Status.Allowed = review.Spec.ResourceAttributes.Name != denied
+		return true, review, nil
+	})
+
+	return c.ParamsStruct{
+		Flags:         map[string]bool{},
+		Params:        map[string]string{},
+		ClientSet:     clientSet,
+		DynamicClient: dynamicClient,
+	}, dynamicClient
+}
+
+func TestApplyAtomic(t *testing.T) {
+	original := map[string]map[string]string{
+		"cm-1": {"app": "old"},
+		"cm-2": nil,
+		"cm-3": {"app": "old", "tier": "web"},
+	}
+	labeled := map[string]map[string]string{
+		"cm-1": {"app": "new"},
+		"cm-2": {"app": "new"},
+		"cm-3": {"app": "new", "tier": "web"},
+	}
+	tests := []struct {
+		name        string
+		denied      string
+		failDryRun  string
+		failPatch   int
+		wantErr     bool
+		want        map[string]map[string]string
+		wantJournal int
+	}{
+		{name: "all patched", want: labeled, wantJournal: 3},
+		{name: "patch not allowed", denied: "cm-2", wantErr: true, want: original},
+		{name: "dry run fails", failDryRun: "cm-3", wantErr: true, want: original},
+		{name: "first patch fails", failPatch: 1, wantErr: true, want: original},
+		{name: "second patch fails", failPatch: 2, wantErr: true, want: original},
+		{name: "last patch fails", failPatch: 3, wantErr: true, want: original},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var objs []runtime.Object
+			var resources []c.ResourceStruct
+			for _, name := range []string{"cm-1", "cm-2", "cm-3"} {
+				objs = append(objs, newConfigMap(name, original[name]))
+				resources = append(resources, c.ResourceStruct{Version: "v1", Resource: "configmaps", Namespace: "default", ObjectName: name})
+			}
+			p, dynamicClient := atomicParams(objs, tt.denied, tt.failDryRun, len(resources), tt.failPatch)
+
+			mark := undoJournal.Mark()
+			defer undoJournal.Truncate(mark)
+
+			err := ApplyAtomic(resources, map[string]string{"app": "new"}, nil, p)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ApplyAtomic() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			for _, r := range resources {
+				obj, err := dynamicClient.Tracker().Get(configMapsGVR, r.Namespace, r.ObjectName)
+				if err != nil {
+					t.Fatalf("get %q: %v", r.ObjectName, err)
+				}
+				got := obj.(*unstructured.Unstructured).GetLabels()
+				if fmt.Sprint(got) != fmt.Sprint(tt.want[r.ObjectName]) {
+					t.Errorf("labels of %q = %v, want %v", r.ObjectName, got, tt.want[r.ObjectName])
+				}
+			}
+			if got := len(undoJournal.Since(mark)); got != tt.wantJournal {
+				t.Errorf("journal holds %d changes, want %d", got, tt.wantJournal)
+			}
+		})
+	}
+}
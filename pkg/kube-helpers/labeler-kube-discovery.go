@@ -0,0 +1,152 @@
+package kubeHelpers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	c "github.com/clubanderson/labeler/pkg/common"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/discovery/cached/disk"
+	"k8s.io/client-go/restmapper"
+)
+
+const defaultDiscoveryCacheTTL = 60 * time.Second
+
+// restMappers holds the RESTMapper of every cluster (by API server host) used in this run
+var restMappers = map[string]*restmapper.DeferredDiscoveryRESTMapper{}
+
+var invalidCacheDirChars = regexp.MustCompile(`[^(\w/.)]`)
+
+// RESTMapper returns the RESTMapper for the cluster of p.RestConfig. It is built once per cluster and run and shared
+// by every traversal and plugin, and it is backed by a discovery client cached on disk (--l-discovery-cache-dir,
+// --l-discovery-cache-ttl), so a large input costs a single discovery pass. API groups that fail discovery
+// (e.g. an unavailable aggregated API) are left out rather than failing the run.
+func RESTMapper(p c.ParamsStruct) (*restmapper.DeferredDiscoveryRESTMapper, error) {
+	if p.RestConfig == nil {
+		return nil, errors.New("no cluster connection")
+	}
+	if mapper, ok := restMappers[p.RestConfig.Host]; ok {
+		return mapper, nil
+	}
+
+	cacheDir := DiscoveryCacheDir(p)
+	// one discovery cache per API server, like kubectl
+	host := strings.TrimPrefix(strings.TrimPrefix(p.RestConfig.Host, "https://"), "http://")
+	discoveryDir := filepath.Join(cacheDir, "discovery", invalidCacheDirChars.ReplaceAllString(host, "_"))
+	cachedDiscoveryClient, err := disk.NewCachedDiscoveryClientForConfig(p.RestConfig, discoveryDir, filepath.Join(cacheDir, "http"), DiscoveryCacheTTL(p))
+	if err != nil {
+		return nil, err
+	}
+
+	_, _, err = cachedDiscoveryClient.ServerGroupsAndResources()
+	if err != nil {
+		if !discovery.IsGroupDiscoveryFailedError(err) {
+			return nil, err
+		}
+		if p.Flags["l-debug"] {
+			log.Printf("labeler.go: [debug] some API groups are unavailable, their objects cannot be labeled: %v\n", err)
+		}
+	}
+
+	mapper := restmapper.NewDeferredDiscoveryRESTMapper(cachedDiscoveryClient)
+	restMappers[p.RestConfig.Host] = mapper
+	return mapper, nil
+}
+
+// DiscoveryCacheDir returns the directory discovery results are cached in (--l-discovery-cache-dir). The shell does
+// not expand ~ in --l-discovery-cache-dir=~/.kube/cache, labeler does.
+func DiscoveryCacheDir(p c.ParamsStruct) string {
+	dir := p.Params["l-discovery-cache-dir"]
+	if dir == "" {
+		dir = c.Flags.DiscoveryCacheDir
+	}
+	if dir == "" {
+		return filepath.Join(c.StateDir(p.HomeDir), "cache")
+	}
+	if dir == "~" || strings.HasPrefix(dir, "~/") {
+		dir = filepath.Join(p.HomeDir, dir[1:])
+	}
+	return dir
+}
+
+// DiscoveryCacheTTL returns how long cached discovery results are used before they are refreshed (--l-discovery-cache-ttl)
+func DiscoveryCacheTTL(p c.ParamsStruct) time.Duration {
+	ttl := p.Params["l-discovery-cache-ttl"]
+	if ttl == "" {
+		ttl = c.Flags.DiscoveryCacheTTL
+	}
+	if ttl == "" {
+		return defaultDiscoveryCacheTTL
+	}
+	d, err := time.ParseDuration(ttl)
+	if err != nil {
+		log.Printf("labeler.go: invalid --l-discovery-cache-ttl duration %q: %v\n", ttl, err)
+		return defaultDiscoveryCacheTTL
+	}
+	return d
+}
+
+const crdEstablishTimeout = 30 * time.Second
+
+var crdGVR = schema.GroupVersionResource{Group: "apiextensions.k8s.io", Version: "v1", Resource: "customresourcedefinitions"}
+
+// IsCRD reports whether gvk is a CustomResourceDefinition
+func IsCRD(gvk schema.GroupVersionKind) bool {
+	return gvk.Group == crdGVR.Group && gvk.Kind == "CustomResourceDefinition"
+}
+
+// WaitForCRDs waits until the CustomResourceDefinitions are established, so that the RESTMapper can map the kinds
+// they define once it is reset. CRDs that do not exist are waited for as long as --l-wait allows.
+func WaitForCRDs(names []string, p c.ParamsStruct) {
+	deadline := time.Now().Add(crdEstablishTimeout)
+	for _, name := range names {
+		backoff := initialBackoff
+		for {
+			var crd *unstructured.Unstructured
+			err := retryNotFound("", name, crdGVR, p, func() error {
+				var err error
+				crd, err = p.DynamicClient.Resource(crdGVR).Get(context.TODO(), name, metav1.GetOptions{})
+				return err
+			})
+			if err != nil {
+				if p.Flags["l-debug"] {
+					log.Printf("labeler.go: [debug] could not get CRD %q: %v\n", name, err)
+				}
+				break
+			}
+			if crdEstablished(crd) {
+				break
+			}
+			if time.Now().After(deadline) {
+				log.Printf("labeler.go: CRD %q is not established after %v\n", name, crdEstablishTimeout)
+				break
+			}
+			if p.Flags["l-debug"] {
+				log.Printf("labeler.go: [debug] waiting for CRD %q to be established\n", name)
+			}
+			time.Sleep(backoff)
+			backoff *= 2
+			if backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+		}
+	}
+}
+
+func crdEstablished(crd *unstructured.Unstructured) bool {
+	conditions, _, _ := unstructured.NestedSlice(crd.Object, "status", "conditions")
+	for _, condition := range conditions {
+		if m, ok := condition.(map[string]interface{}); ok && m["type"] == "Established" && m["status"] == "True" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,57 @@
+package kubeHelpers
+
+import (
+	"testing"
+	"time"
+
+	c "github.com/clubanderson/labeler/pkg/common"
+)
+
+func TestDiscoveryCacheDir(t *testing.T) {
+	tests := []struct {
+		name  string
+		param string
+		flag  string
+		want  string
+	}{
+		{name: "default", want: "/home/me/.labeler/cache"},
+		{name: "param", param: "/var/cache/labeler", want: "/var/cache/labeler"},
+		{name: "flag", flag: "/var/cache/labeler", want: "/var/cache/labeler"},
+		{name: "param wins over flag", param: "/a", flag: "/b", want: "/a"},
+		{name: "tilde", param: "~/.kube/cache", want: "/home/me/.kube/cache"},
+		{name: "tilde only", flag: "~", want: "/home/me"},
+		{name: "tilde of another user", param: "~other/cache", want: "~other/cache"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			saved := c.Flags
+			defer func() { c.Flags = saved }()
+			c.Flags.DiscoveryCacheDir = tt.flag
+
+			p := c.ParamsStruct{HomeDir: "/home/me", Params: map[string]string{"l-discovery-cache-dir": tt.param}}
+			if got := DiscoveryCacheDir(p); got != tt.want {
+				t.Errorf("DiscoveryCacheDir() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiscoveryCacheTTL(t *testing.T) {
+	tests := []struct {
+		name  string
+		param string
+		want  time.Duration
+	}{
+		{name: "default", want: 60 * time.Second},
+		{name: "duration", param: "1h", want: time.Hour},
+		{name: "invalid", param: "soon", want: 60 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := c.ParamsStruct{Params: map[string]string{"l-discovery-cache-ttl": tt.param}}
+			if got := DiscoveryCacheTTL(p); got != tt.want {
+				t.Errorf("DiscoveryCacheTTL() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
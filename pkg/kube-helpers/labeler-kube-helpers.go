@@ -6,38 +6,51 @@ import (
 	"fmt"
 	"log"
 	"strings"
+	"time"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	c "github.com/clubanderson/labeler/pkg/common"
+	undoJournal "github.com/clubanderson/labeler/pkg/undo-journal"
 	"gopkg.in/yaml.v3"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
 )
 
-func AddNamespaceToResources(p c.ParamsStruct) error {
+const (
+	initialBackoff = 500 * time.Millisecond
+	maxBackoff     = 15 * time.Second
+)
+
+// SetNamespaceArg sets the namespaceArg param to the namespace given with -n/--namespace, it is left empty otherwise
+// as the namespace then comes from the kubeconfig context
+func SetNamespaceArg(p c.ParamsStruct) {
 	p.Params["namespaceArg"] = ""
 	if p.Params["namespace"] != "" {
 		p.Params["namespaceArg"] = p.Params["namespace"]
 	} else if p.Params["n"] != "" {
 		p.Params["namespaceArg"] = p.Params["n"]
 	}
-	if p.Params["namespaceArg"] == "" {
-		p.Params["namespaceArg"] = "default"
-	}
+}
+
+// AddNamespaceToResources adds the namespace the objects of the run default to, so that it is labeled with them
+func AddNamespaceToResources(p c.ParamsStruct, namespace string) error {
 
 	resource := c.ResourceStruct{
 		Group:      "",
 		Version:    "v1",
 		Resource:   "namespaces",
 		Namespace:  "",
-		ObjectName: p.Params["namespaceArg"],
+		ObjectName: namespace,
 	}
+	c.RunResults.RecordKind(schema.GroupVersionResource{Version: "v1", Resource: "namespaces"}, "Namespace")
 	namespaceYAML := c.Namespace{
 		APIVersion: "v1",
 		Kind:       "namespace",
 		Metadata: c.Metadata{
-			Name: p.Params["namespaceArg"],
+			Name: namespace,
 		},
 	}
 	yamlData, err := yaml.Marshal(namespaceYAML)
@@ -59,70 +72,173 @@ func SetLabel(namespace, objectName string, gvr schema.GroupVersionResource, p c
 		return nil
 	}
 	if c.Flags.Label != "" {
-		p.Params["labelKey"], p.Params["labelVal"] = strings.Split(c.Flags.Label, "=")[0], strings.Split(c.Flags.Label, "=")[1]
+		key, val, found := strings.Cut(c.Flags.Label, "=")
+		if !found || key == "" {
+			return fmt.Errorf("label %q is not of the form key=value", c.Flags.Label)
+		}
+		p.Params["labelKey"], p.Params["labelVal"] = key, val
 	}
 
 	labels := map[string]string{
 		p.Params["labelKey"]: p.Params["labelVal"],
 	}
 
-	// serialize labels to JSON
-	patch, err := json.Marshal(map[string]interface{}{
-		"metadata": map[string]interface{}{
-			"labels": labels,
-		},
-	})
-	if err != nil {
-		return err
-	}
-
 	if p.Flags["l-debug"] {
-		log.Printf("labeler.go: patching object %v/%v/%v %q in namespace %q with %v=%v %q %q %q %v\n", gvr.Group, gvr.Version, gvr.Resource, objectName, namespace, p.Params["labelKey"], p.Params["labelVal"], gvr.Resource, gvr.Version, gvr.Group, string(patch))
+		log.Printf("labeler.go: patching object %v/%v/%v %q in namespace %q with %v=%v\n", gvr.Group, gvr.Version, gvr.Resource, objectName, namespace, p.Params["labelKey"], p.Params["labelVal"])
 	}
-	if namespace == "" {
-		_, err = p.DynamicClient.Resource(gvr).Patch(context.TODO(), objectName, types.MergePatchType, patch, metav1.PatchOptions{})
-		if err != nil {
-			if p.Flags["l-debug"] {
-				log.Printf("labeler.go: error patching object %v/%v/%v %q in namespace %q: %v\n", gvr.Group, gvr.Version, gvr.Resource, objectName, namespace, err)
-			}
+	err := PatchMetadata("labels", labels, namespace, objectName, gvr, p)
+	if err != nil {
+		if p.Flags["l-debug"] {
+			log.Printf("labeler.go: error patching object %v/%v/%v %q in namespace %q: %v\n", gvr.Group, gvr.Version, gvr.Resource, objectName, namespace, err)
 		}
-	} else {
-		_, err = p.DynamicClient.Resource(gvr).Namespace(namespace).Patch(context.TODO(), objectName, types.MergePatchType, patch, metav1.PatchOptions{})
-		if err != nil {
-			if p.Flags["l-debug"] {
-				log.Printf("labeler.go: error patching object %v/%v/%v %q in namespace %q: %v\n", gvr.Group, gvr.Version, gvr.Resource, objectName, namespace, err)
+		if errors.IsNotFound(err) {
+			resource := c.ResourceStruct{Group: gvr.Group, Version: gvr.Version, Resource: gvr.Resource, Namespace: namespace, ObjectName: objectName}
+			c.RunResults.DeferLabel(resource, p.Params["labelKey"], p.Params["labelVal"])
+			if namespace != "" {
+				labelCmd := fmt.Sprintf("kubectl label %v %v %v=%v -n %q\n", gvr.Resource, objectName, p.Params["labelKey"], p.Params["labelVal"], namespace)
+				c.RunResults.DidNotLabel = append(c.RunResults.DidNotLabel, labelCmd)
+			} else {
+				labelCmd := fmt.Sprintf("kubectl label %v %v %v=%v\n", gvr.Resource, objectName, p.Params["labelKey"], p.Params["labelVal"])
+				c.RunResults.DidNotLabel = append(c.RunResults.DidNotLabel, labelCmd)
 			}
+		} else {
+			failure := fmt.Sprintf("%v/%v/%v %q in namespace %q: %v\n", gvr.Group, gvr.Version, gvr.Resource, objectName, namespace, err)
+			c.RunResults.FailedToLabel = append(c.RunResults.FailedToLabel, failure)
 		}
+		return err
 	}
 
+	log.Printf("  🏷️ labeled object %v/%v/%v %q in namespace %q with %v=%v\n", gvr.Group, gvr.Version, gvr.Resource, objectName, namespace, p.Params["labelKey"], p.Params["labelVal"])
+	return nil
+}
+
+// StartWait returns p with the wait deadline of a new phase of the run. The deadline is shared by every object of the
+// phase, so a chart with many missing objects waits at most --l-wait.
+func StartWait(p c.ParamsStruct) c.ParamsStruct {
+	p.WaitDeadline = time.Now().Add(WaitDuration(p))
+	return p
+}
+
+// WaitDuration returns how long labeler should keep retrying objects that do not exist yet (--l-wait).
+// A zero duration means objects are patched once and deferred if they are not found.
+func WaitDuration(p c.ParamsStruct) time.Duration {
+	wait := p.Params["l-wait"]
+	if wait == "" {
+		wait = c.Flags.Wait
+	}
+	if wait == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(wait)
 	if err != nil {
-		if namespace != "" {
-			labelCmd := fmt.Sprintf("kubectl label %v %v %v=%v -n %q\n", gvr.Resource, objectName, p.Params["labelKey"], p.Params["labelVal"], namespace)
-			c.RunResults.DidNotLabel = append(c.RunResults.DidNotLabel, labelCmd)
+		log.Printf("labeler.go: invalid --l-wait duration %q: %v\n", wait, err)
+		return 0
+	}
+	return d
+}
+
+// PatchObject applies a merge patch to an object. Objects that are not found are retried with
+// exponential backoff until the --l-wait deadline passes, so that objects created asynchronously
+// (helm install, CRs waiting for their CRD) are labeled once they appear.
+func PatchObject(namespace, objectName string, gvr schema.GroupVersionResource, patch []byte, p c.ParamsStruct) error {
+	return retryNotFound(namespace, objectName, gvr, p, func() error {
+		var err error
+		if namespace == "" {
+			_, err = p.DynamicClient.Resource(gvr).Patch(context.TODO(), objectName, types.MergePatchType, patch, metav1.PatchOptions{})
 		} else {
-			labelCmd := fmt.Sprintf("kubectl label %v %v %v=%v\n", gvr.Resource, objectName, p.Params["labelKey"], p.Params["labelVal"])
-			c.RunResults.DidNotLabel = append(c.RunResults.DidNotLabel, labelCmd)
+			_, err = p.DynamicClient.Resource(gvr).Namespace(namespace).Patch(context.TODO(), objectName, types.MergePatchType, patch, metav1.PatchOptions{})
 		}
 		return err
+	})
+}
+
+// PatchMetadata sets labels or annotations (field is "labels" or "annotations") on an object. The values being
+// replaced are recorded in the run journal so that 'labeler undo' can restore them.
+func PatchMetadata(field string, values map[string]string, namespace, objectName string, gvr schema.GroupVersionResource, p c.ParamsStruct) error {
+	var obj *unstructured.Unstructured
+	err := retryNotFound(namespace, objectName, gvr, p, func() error {
+		var err error
+		if namespace == "" {
+			obj, err = p.DynamicClient.Resource(gvr).Get(context.TODO(), objectName, metav1.GetOptions{})
+		} else {
+			obj, err = p.DynamicClient.Resource(gvr).Namespace(namespace).Get(context.TODO(), objectName, metav1.GetOptions{})
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	current := obj.GetLabels()
+	if field == "annotations" {
+		current = obj.GetAnnotations()
+	}
+	unchanged := true
+	for key, val := range values {
+		if before, ok := current[key]; !ok || before != val {
+			unchanged = false
+		}
+	}
+	if unchanged {
+		// already in place, e.g. injected by the helm post-renderer
+		return nil
 	}
 
-	log.Printf("  🏷️ labeled object %v/%v/%v %q in namespace %q with %v=%v\n", gvr.Group, gvr.Version, gvr.Resource, objectName, namespace, p.Params["labelKey"], p.Params["labelVal"])
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			field: values,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	err = PatchObject(namespace, objectName, gvr, patch, p)
+	if err != nil {
+		return err
+	}
+
+	resource := c.ResourceStruct{Group: gvr.Group, Version: gvr.Version, Resource: gvr.Resource, Namespace: namespace, ObjectName: objectName}
+	for key, val := range values {
+		change := undoJournal.ChangeStruct{Resource: resource, Field: field, Key: key, After: val}
+		if before, ok := current[key]; ok {
+			if before == val {
+				continue
+			}
+			change.Before = &before
+		}
+		undoJournal.Record(change)
+	}
 	return nil
 }
 
-func LabelResources(p c.ParamsStruct) error {
-	for r, v := range p.Resources {
-		_ = v
-		gvr := schema.GroupVersionResource{
-			Group:    r.Group,
-			Version:  r.Version,
-			Resource: r.Resource,
+// retryNotFound runs fn until it succeeds, fails with an error other than not found, or the --l-wait deadline
+// passes, backing off exponentially between attempts
+func retryNotFound(namespace, objectName string, gvr schema.GroupVersionResource, p c.ParamsStruct, fn func() error) error {
+	deadline := p.WaitDeadline
+	if deadline.IsZero() {
+		// outside of a phase each object is waited for on its own
+		deadline = time.Now().Add(WaitDuration(p))
+	}
+	backoff := initialBackoff
+	for {
+		err := fn()
+		if err == nil || !errors.IsNotFound(err) {
+			return err
 		}
-		err := SetLabel(r.Namespace, r.ObjectName, gvr, p)
-		if err != nil {
-			log.Println("labeler.go: error (setLabel):", err)
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
 			return err
 		}
+		if backoff > remaining {
+			backoff = remaining
+		}
+		if p.Flags["l-debug"] {
+			log.Printf("labeler.go: object %v/%v/%v %q in namespace %q not found yet, retrying in %v\n", gvr.Group, gvr.Version, gvr.Resource, objectName, namespace, backoff)
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
 	}
-	return nil
 }
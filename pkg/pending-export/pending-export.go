@@ -0,0 +1,183 @@
+package pendingExport
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	c "github.com/clubanderson/labeler/pkg/common"
+
+	"gopkg.in/yaml.v3"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+const (
+	FormatScript    = "script"
+	FormatPatches   = "patches"
+	FormatKustomize = "kustomize"
+)
+
+// KindFunc returns the kind of a resource, it is needed for the kustomize format only
+type KindFunc func(gvr schema.GroupVersionResource) (schema.GroupVersionKind, error)
+
+// Write exports label and annotation operations to path in the given format:
+//   - script: a shell script of 'kubectl label' and 'kubectl annotate' commands
+//   - patches: a directory of JSON merge patches, one per object, and an apply.sh that runs 'kubectl patch' with them
+//   - kustomize: a directory with a kustomize component (patches only, it has no resources of its own) and one patch
+//     per object, to be added to the components of the kustomization that produces the objects
+func Write(path, format string, ops []c.PendingStruct, kindFor KindFunc) error {
+	sort.Slice(ops, func(i, j int) bool {
+		return resourceFileName(ops[i].Resource) < resourceFileName(ops[j].Resource)
+	})
+	switch format {
+	case "", FormatScript:
+		return writeScript(path, ops)
+	case FormatPatches:
+		return writePatches(path, ops)
+	case FormatKustomize:
+		return writeKustomize(path, ops, kindFor)
+	}
+	return fmt.Errorf("unknown export format %q, use %v, %v or %v", format, FormatScript, FormatPatches, FormatKustomize)
+}
+
+func writeScript(path string, ops []c.PendingStruct) error {
+	var sb strings.Builder
+	sb.WriteString("#!/bin/sh\n# label and annotation operations deferred by labeler\nset -e\n\n")
+	for _, op := range ops {
+		if len(op.Labels) > 0 {
+			sb.WriteString(kubectlCommand("label", op.Resource, op.Labels))
+		}
+		if len(op.Annotations) > 0 {
+			sb.WriteString(kubectlCommand("annotate", op.Resource, op.Annotations))
+		}
+	}
+	return os.WriteFile(path, []byte(sb.String()), 0755)
+}
+
+func writePatches(dir string, ops []c.PendingStruct) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	var sb strings.Builder
+	sb.WriteString("#!/bin/sh\n# label and annotation operations deferred by labeler, run from this directory\nset -e\n\n")
+	for _, op := range ops {
+		patch, err := json.MarshalIndent(map[string]interface{}{"metadata": metadata(op)}, "", "  ")
+		if err != nil {
+			return err
+		}
+		fileName := resourceFileName(op.Resource) + ".json"
+		if err := os.WriteFile(filepath.Join(dir, fileName), append(patch, '\n'), 0644); err != nil {
+			return err
+		}
+		sb.WriteString(fmt.Sprintf("kubectl patch %v %v%v --type merge --patch-file %v\n", resourceArg(op.Resource), shellQuote(op.Resource.ObjectName), namespaceArg(op.Resource), fileName))
+	}
+	return os.WriteFile(filepath.Join(dir, "apply.sh"), []byte(sb.String()), 0755)
+}
+
+func writeKustomize(dir string, ops []c.PendingStruct, kindFor KindFunc) error {
+	if kindFor == nil {
+		return fmt.Errorf("the kustomize format needs the kinds of the objects")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	var patchFiles []string
+	for _, op := range ops {
+		gvk, err := kindFor(schema.GroupVersionResource{Group: op.Resource.Group, Version: op.Resource.Version, Resource: op.Resource.Resource})
+		if err != nil {
+			return fmt.Errorf("could not find the kind of %v/%v/%v: %v", op.Resource.Group, op.Resource.Version, op.Resource.Resource, err)
+		}
+		meta := metadata(op)
+		meta["name"] = op.Resource.ObjectName
+		if op.Resource.Namespace != "" {
+			meta["namespace"] = op.Resource.Namespace
+		}
+		patch, err := yaml.Marshal(map[string]interface{}{
+			"apiVersion": gvk.GroupVersion().String(),
+			"kind":       gvk.Kind,
+			"metadata":   meta,
+		})
+		if err != nil {
+			return err
+		}
+		fileName := resourceFileName(op.Resource) + ".yaml"
+		if err := os.WriteFile(filepath.Join(dir, fileName), patch, 0644); err != nil {
+			return err
+		}
+		patchFiles = append(patchFiles, fileName)
+	}
+
+	// a component, as the patches need the objects of the kustomization that includes it
+	var sb strings.Builder
+	sb.WriteString("# label and annotation operations deferred by labeler, add this directory to the components of the\n")
+	sb.WriteString("# kustomization that produces these objects:\n#\n#   components:\n#   - <path to this directory>\n")
+	sb.WriteString("apiVersion: kustomize.config.k8s.io/v1alpha1\nkind: Component\npatches:\n")
+	for _, fileName := range patchFiles {
+		sb.WriteString("- path: " + fileName + "\n")
+	}
+	return os.WriteFile(filepath.Join(dir, "kustomization.yaml"), []byte(sb.String()), 0644)
+}
+
+func metadata(op c.PendingStruct) map[string]interface{} {
+	meta := map[string]interface{}{}
+	if len(op.Labels) > 0 {
+		meta["labels"] = op.Labels
+	}
+	if len(op.Annotations) > 0 {
+		meta["annotations"] = op.Annotations
+	}
+	return meta
+}
+
+func kubectlCommand(verb string, r c.ResourceStruct, values map[string]string) string {
+	var keys []string
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var pairs []string
+	for _, k := range keys {
+		pairs = append(pairs, shellQuote(k+"="+values[k]))
+	}
+	return fmt.Sprintf("kubectl %v %v %v %v%v --overwrite\n", verb, resourceArg(r), shellQuote(r.ObjectName), strings.Join(pairs, " "), namespaceArg(r))
+}
+
+// resourceArg fully qualifies the resource (deployments.v1.apps), so that the commands do not depend on discovery
+// preferring the same version. Core resources have no group and are left as they are.
+func resourceArg(r c.ResourceStruct) string {
+	if r.Group == "" {
+		return r.Resource
+	}
+	return r.Resource + "." + r.Version + "." + r.Group
+}
+
+func namespaceArg(r c.ResourceStruct) string {
+	if r.Namespace == "" {
+		return ""
+	}
+	return " -n " + shellQuote(r.Namespace)
+}
+
+func resourceFileName(r c.ResourceStruct) string {
+	parts := []string{r.Resource}
+	if r.Group != "" {
+		parts[0] += "." + r.Group
+	}
+	if r.Namespace != "" {
+		parts = append(parts, r.Namespace)
+	}
+	parts = append(parts, r.ObjectName)
+	return strings.Join(parts, "_")
+}
+
+func shellQuote(s string) string {
+	if s != "" && strings.IndexFunc(s, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_./=:", r))
+	}) == -1 {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'"'"'`) + "'"
+}
@@ -0,0 +1,163 @@
+package pendingExport
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	c "github.com/clubanderson/labeler/pkg/common"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+func pendingOps() []c.PendingStruct {
+	return []c.PendingStruct{
+		{
+			Resource:    c.ResourceStruct{Group: "apps", Version: "v1", Resource: "deployments", Namespace: "sealed-secrets", ObjectName: "sealed-secrets"},
+			Labels:      map[string]string{"app.kubernetes.io/part-of": "sample-app"},
+			Annotations: map[string]string{"creator": "John Doe"},
+		},
+		{
+			Resource: c.ResourceStruct{Version: "v1", Resource: "namespaces", ObjectName: "default"},
+			Labels:   map[string]string{"app.kubernetes.io/part-of": "sample-app"},
+		},
+		{
+			Resource: c.ResourceStruct{Group: "rbac.authorization.k8s.io", Version: "v1", Resource: "clusterroles", ObjectName: "secrets-unsealer"},
+			Labels:   map[string]string{"app.kubernetes.io/part-of": "sample-app", "team": "it's ours"},
+		},
+	}
+}
+
+func kindFor(gvr schema.GroupVersionResource) (schema.GroupVersionKind, error) {
+	kinds := map[string]string{"deployments": "Deployment", "namespaces": "Namespace", "clusterroles": "ClusterRole"}
+	kind, ok := kinds[gvr.Resource]
+	if !ok {
+		return schema.GroupVersionKind{}, fmt.Errorf("unknown resource %v", gvr.Resource)
+	}
+	return gvr.GroupVersion().WithKind(kind), nil
+}
+
+func TestWrite(t *testing.T) {
+	tests := []struct {
+		format string
+		golden string
+	}{
+		{format: "", golden: "script/pending.sh"},
+		{format: FormatScript, golden: "script/pending.sh"},
+		{format: FormatPatches, golden: "patches"},
+		{format: FormatKustomize, golden: "kustomize"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			out := filepath.Join(t.TempDir(), filepath.Base(tt.golden))
+			if err := Write(out, tt.format, pendingOps(), kindFor); err != nil {
+				t.Fatal(err)
+			}
+			golden := filepath.Join("testdata", tt.golden)
+			if *update {
+				if err := os.RemoveAll(golden); err != nil {
+					t.Fatal(err)
+				}
+				updateGolden(t, out, golden)
+			}
+			compareGolden(t, out, golden)
+		})
+	}
+}
+
+func TestWriteErrors(t *testing.T) {
+	dir := t.TempDir()
+	if err := Write(filepath.Join(dir, "pending"), "yaml", pendingOps(), kindFor); err == nil {
+		t.Error("Write() with an unknown format did not fail")
+	}
+	if err := Write(filepath.Join(dir, "pending"), FormatKustomize, pendingOps(), nil); err == nil {
+		t.Error("Write() of the kustomize format without kinds did not fail")
+	}
+	ops := append(pendingOps(), c.PendingStruct{
+		Resource: c.ResourceStruct{Group: "bitnami.com", Version: "v1alpha1", Resource: "sealedsecrets", Namespace: "default", ObjectName: "x"},
+		Labels:   map[string]string{"app": "x"},
+	})
+	if err := Write(filepath.Join(dir, "pending"), FormatKustomize, ops, kindFor); err == nil {
+		t.Error("Write() of the kustomize format with an unknown kind did not fail")
+	}
+}
+
+// updateGolden copies a written file, or the files of a written directory, to the golden path
+func updateGolden(t *testing.T, got, golden string) {
+	t.Helper()
+	files := []string{got}
+	if info, err := os.Stat(got); err == nil && info.IsDir() {
+		if err := os.MkdirAll(golden, 0755); err != nil {
+			t.Fatal(err)
+		}
+		entries, err := os.ReadDir(got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = nil
+		for _, entry := range entries {
+			files = append(files, filepath.Join(got, entry.Name()))
+		}
+	} else if err := os.MkdirAll(filepath.Dir(golden), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		target := golden
+		if file != got {
+			target = filepath.Join(golden, filepath.Base(file))
+		}
+		if err := os.WriteFile(target, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// compareGolden compares a written file, or every file of a written directory, with the golden one
+func compareGolden(t *testing.T, got, golden string) {
+	t.Helper()
+	info, err := os.Stat(golden)
+	if err != nil {
+		t.Fatalf("missing golden file, run go test with -update: %v", err)
+	}
+	if !info.IsDir() {
+		compareFile(t, got, golden)
+		return
+	}
+	entries, err := os.ReadDir(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	goldenEntries, err := os.ReadDir(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != len(goldenEntries) {
+		t.Errorf("%v has %d files, want %d", got, len(entries), len(goldenEntries))
+	}
+	for _, entry := range goldenEntries {
+		compareFile(t, filepath.Join(got, entry.Name()), filepath.Join(golden, entry.Name()))
+	}
+}
+
+func compareFile(t *testing.T, got, golden string) {
+	t.Helper()
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != string(want) {
+		t.Errorf("%v differs from %v:\n%s\nwant:\n%s", filepath.Base(got), golden, data, want)
+	}
+}
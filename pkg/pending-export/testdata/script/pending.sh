@@ -0,0 +1,8 @@
+#!/bin/sh
+# label and annotation operations deferred by labeler
+set -e
+
+kubectl label clusterroles.v1.rbac.authorization.k8s.io secrets-unsealer app.kubernetes.io/part-of=sample-app 'team=it'"'"'s ours' --overwrite
+kubectl label deployments.v1.apps sealed-secrets app.kubernetes.io/part-of=sample-app -n sealed-secrets --overwrite
+kubectl annotate deployments.v1.apps sealed-secrets 'creator=John Doe' -n sealed-secrets --overwrite
+kubectl label namespaces default app.kubernetes.io/part-of=sample-app --overwrite
@@ -128,9 +128,9 @@ func PluginCreateBP(p c.ParamsStruct, reflect bool) []string {
 		}
 		err = p.CreateObjForPlugin(gvk, yamlData, n, r, p.Params["l-bp-wds"], objectJSON)
 		if err != nil {
-			log.Printf("  🔴 failed to create %v object %q in namespace %v.\n", r, n, p.Params["namespaceArg"])
+			log.Printf("  🔴 failed to create %v object %q in WDS %q.\n", r, n, p.Params["l-bp-wds"])
 		} else {
-			log.Printf("  🟢 successfully created %v object %q in namespace %v.\n", r, n, p.Params["namespaceArg"])
+			log.Printf("  🟢 successfully created %v object %q in WDS %q.\n", r, n, p.Params["l-bp-wds"])
 		}
 	} else {
 		fmt.Printf("%v", string(yamlData))
@@ -15,16 +15,22 @@ func PluginHelp(p c.ParamsStruct, reflect bool) []string {
 	}
 	log.Println()
 	log.Println("Labeler supported parameters and flags")
+	flagWidth := 35
+	value1Width := 10
+	formatString := fmt.Sprintf("    %%-%ds  %%-%ds  %%s\n", flagWidth, value1Width)
 	for k, v := range p.PluginArgs {
 		log.Printf("\n  plugin: %q", k)
 		for _, vCSV := range v {
 			v := strings.Split(vCSV, ",")
-			flagWidth := 35
-			value1Width := 10
-			formatString := fmt.Sprintf("    %%-%ds  %%-%ds  %%s\n", flagWidth, value1Width)
 			log.Printf(formatString, "--"+v[0], "("+v[1]+")", strings.Join(v[2:], ","))
 		}
 	}
+	// the args of labeler itself
+	log.Printf("\n  labeler:")
+	for _, vCSV := range c.GlobalFlags {
+		v := strings.Split(vCSV, ",")
+		log.Printf(formatString, "--"+v[0], "("+v[1]+")", strings.Join(v[2:], ","))
+	}
 	log.Println()
 
 	return []string{}
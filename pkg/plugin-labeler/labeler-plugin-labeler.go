@@ -16,6 +16,27 @@ func PluginLabeler(p c.ParamsStruct, reflect bool) []string {
 		return []string{"label,string,label key and value to be applied to objects (usage: --label=app.kubernetes.io/part-of=sample)"}
 	}
 
+	if p.Flags["l-atomic"] && (p.Flags["upgrade"] || p.Flags["install"] || p.Flags["apply"] || p.Flags["create"] || p.Flags["replace"]) {
+		// labels and annotations are applied together, the annotator plugin skips atomic runs
+		labels := map[string]string{}
+		if p.Params["labelKey"] != "" && p.Params["labelVal"] != "" {
+			labels[p.Params["labelKey"]] = p.Params["labelVal"]
+		}
+		var resources []c.ResourceStruct
+		for r := range p.Resources {
+			if r.Resource == "namespaces" && (r.ObjectName == "" || r.ObjectName == "default") {
+				continue
+			}
+			resources = append(resources, r)
+		}
+		err := k.ApplyAtomic(resources, labels, c.KeyValues(p.Params["l-annotation"]), p)
+		if err != nil {
+			log.Println("labeler.go: error (atomic):", err)
+		}
+		log.Println()
+		return []string{}
+	}
+
 	if p.Params["labelKey"] != "" && p.Params["labelVal"] != "" && (p.Flags["upgrade"] || p.Flags["install"] || p.Flags["apply"] || p.Flags["create"] || p.Flags["replace"]) {
 		for r, v := range p.Resources {
 			_ = v
@@ -27,6 +48,7 @@ func PluginLabeler(p c.ParamsStruct, reflect bool) []string {
 			var err error
 			if gvr.Resource == "namespaces" {
 				if r.ObjectName == "" || r.ObjectName == "default" {
+					c.RunResults.SkipLabel(r, p.Params["labelKey"], p.Params["labelVal"])
 					labelCmd := fmt.Sprintf("kubectl label %v %v %v=%v\n", gvr.Resource, r.ObjectName, p.Params["labelKey"], p.Params["labelVal"])
 					c.RunResults.DidNotLabel = append(c.RunResults.DidNotLabel, labelCmd)
 				} else {
@@ -43,13 +65,5 @@ func PluginLabeler(p c.ParamsStruct, reflect bool) []string {
 			}
 		}
 	}
-	if len(c.RunResults.DidNotLabel) > 0 {
-		log.Printf("\nlabeler.go: The following resources can be labeled at a later time:\n\n")
-		for _, cmd := range c.RunResults.DidNotLabel {
-			log.Printf("%v", cmd)
-		}
-	}
-	log.Println()
-
 	return []string{}
 }
@@ -91,19 +91,23 @@ func PluginCreateMW(p c.ParamsStruct, reflect bool) []string {
 	// log.Printf("yamlData: \n%v", string(yamlData))
 
 	if p.Flags["l-mw-create"] {
-		log.Printf("  🚀 attempting to create %v object %q in namespace %q", k, n, p.Params["namespaceArg"])
-		// log.Printf("%v %v %v %v %v %v", gvk.Group, gvk.Version, gvk.Kind, n, r, p.Params["namespaceArg"])
+		namespace := p.Params["namespaceArg"]
+		if namespace == "" {
+			namespace = "default"
+		}
+		log.Printf("  🚀 attempting to create %v object %q in namespace %q", k, n, namespace)
+		// log.Printf("%v %v %v %v %v %v", gvk.Group, gvk.Version, gvk.Kind, n, r, namespace)
 		objectJSON, err := json.Marshal(manifestWork)
 		if err != nil {
 			fmt.Println("Error marshaling JSON:", err)
 			return []string{}
 		}
 		// log.Printf("objectJSON: \n%v", string(objectJSON))
-		err = p.CreateObjForPlugin(gvk, yamlData, n, r, p.Params["namespaceArg"], objectJSON)
+		err = p.CreateObjForPlugin(gvk, yamlData, n, r, namespace, objectJSON)
 		if err != nil {
-			log.Printf("  🔴 failed to create %v object %q in namespace %v.\n", r, n, p.Params["namespaceArg"])
+			log.Printf("  🔴 failed to create %v object %q in namespace %v.\n", r, n, namespace)
 		} else {
-			log.Printf("  🟢 successfully created %v object %q in namespace %v.\n", r, n, p.Params["namespaceArg"])
+			log.Printf("  🟢 successfully created %v object %q in namespace %v.\n", r, n, namespace)
 		}
 	} else {
 		fmt.Printf("%v", string(yamlData))
@@ -0,0 +1,191 @@
+package transformer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	c "github.com/clubanderson/labeler/pkg/common"
+	"gopkg.in/yaml.v3"
+)
+
+// FunctionConfigStruct is the functionConfig of the labeler KRM function. It is read from the spec of a custom
+// resource (any apiVersion and kind), or from the data of a ConfigMap where labels and annotations are
+// comma-separated key=value lists.
+type FunctionConfigStruct struct {
+	Labels       map[string]string `yaml:"labels"`
+	Annotations  map[string]string `yaml:"annotations"`
+	PodTemplates bool              `yaml:"podTemplates"`
+	Include      []SelectorStruct  `yaml:"include"` // when set, only matching objects are transformed
+	Exclude      []SelectorStruct  `yaml:"exclude"` // matching objects are never transformed
+}
+
+// SelectorStruct matches objects, empty fields match anything
+type SelectorStruct struct {
+	Group     string `yaml:"group"`
+	Kind      string `yaml:"kind"`
+	Name      string `yaml:"name"`
+	Namespace string `yaml:"namespace"`
+}
+
+// ResultStruct is an entry of the results of a ResourceList
+type ResultStruct struct {
+	Message     string             `yaml:"message"`
+	Severity    string             `yaml:"severity"`
+	ResourceRef *ResourceRefStruct `yaml:"resourceRef,omitempty"`
+}
+
+type ResourceRefStruct struct {
+	APIVersion string `yaml:"apiVersion"`
+	Kind       string `yaml:"kind"`
+	Name       string `yaml:"name"`
+	Namespace  string `yaml:"namespace,omitempty"`
+}
+
+// RunResourceList implements the KRM function specification: it reads a config.kubernetes.io/v1 ResourceList from
+// r, labels and annotates its items as its functionConfig says, and writes the ResourceList with the transformed
+// items and a results entry for every object that was skipped to w. No cluster is accessed.
+func RunResourceList(r io.Reader, w io.Writer) error {
+	var doc yaml.Node
+	if err := yaml.NewDecoder(r).Decode(&doc); err != nil {
+		return err
+	}
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return errors.New("input is not a ResourceList")
+	}
+	list := doc.Content[0]
+	if kind := lookup(list, "kind"); kind == nil || kind.Value != "ResourceList" {
+		return errors.New("input is not a ResourceList")
+	}
+
+	var results []ResultStruct
+	config, err := functionConfig(lookup(list, "functionConfig"))
+	if err == nil && len(config.Labels) == 0 && len(config.Annotations) == 0 {
+		err = errors.New("functionConfig has no labels or annotations")
+	}
+	if err != nil {
+		results = append(results, ResultStruct{Message: err.Error(), Severity: "error"})
+	} else {
+		opts := OptionsStruct{Labels: config.Labels, Annotations: config.Annotations, PodTemplates: config.PodTemplates}
+		if items := lookup(list, "items"); items != nil && items.Kind == yaml.SequenceNode {
+			for _, item := range items.Content {
+				ref := resourceRef(item)
+				if ref.Kind == "" {
+					results = append(results, ResultStruct{Message: "skipped: item is not a Kubernetes object", Severity: "warning"})
+					continue
+				}
+				if reason := config.skipReason(ref); reason != "" {
+					results = append(results, ResultStruct{Message: "skipped: " + reason, Severity: "info", ResourceRef: &ref})
+					continue
+				}
+				TransformObject(item, opts)
+			}
+		}
+	}
+
+	if len(results) > 0 {
+		var resultsNode yaml.Node
+		if err := resultsNode.Encode(results); err != nil {
+			return err
+		}
+		if existing := lookup(list, "results"); existing != nil {
+			*existing = resultsNode
+		} else {
+			list.Content = append(list.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "results"}, &resultsNode)
+		}
+	}
+
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&doc); err != nil {
+		return err
+	}
+	if err := encoder.Close(); err != nil {
+		return err
+	}
+	// the KRM function specification requires a non-zero exit when a result has severity error
+	for _, result := range results {
+		if result.Severity == "error" {
+			return errors.New(result.Message)
+		}
+	}
+	return nil
+}
+
+func functionConfig(node *yaml.Node) (FunctionConfigStruct, error) {
+	var config FunctionConfigStruct
+	if node == nil || node.Kind != yaml.MappingNode {
+		return config, errors.New("functionConfig is missing")
+	}
+	if kind := lookup(node, "kind"); kind != nil && kind.Value == "ConfigMap" {
+		var data struct {
+			Labels       string `yaml:"labels"`
+			Annotations  string `yaml:"annotations"`
+			PodTemplates string `yaml:"podTemplates"`
+		}
+		if d := lookup(node, "data"); d != nil {
+			if err := d.Decode(&data); err != nil {
+				return config, fmt.Errorf("invalid functionConfig data: %v", err)
+			}
+		}
+		config.Labels = c.KeyValues(data.Labels)
+		config.Annotations = c.KeyValues(data.Annotations)
+		config.PodTemplates = data.PodTemplates == "true"
+		return config, nil
+	}
+	if spec := lookup(node, "spec"); spec != nil {
+		if err := spec.Decode(&config); err != nil {
+			return config, fmt.Errorf("invalid functionConfig spec: %v", err)
+		}
+	}
+	return config, nil
+}
+
+// skipReason returns why the object must not be transformed, or an empty string
+func (config FunctionConfigStruct) skipReason(ref ResourceRefStruct) string {
+	for _, selector := range config.Exclude {
+		if selector.matches(ref) {
+			return "excluded by functionConfig"
+		}
+	}
+	if len(config.Include) == 0 {
+		return ""
+	}
+	for _, selector := range config.Include {
+		if selector.matches(ref) {
+			return ""
+		}
+	}
+	return "not included by functionConfig"
+}
+
+func (selector SelectorStruct) matches(ref ResourceRefStruct) bool {
+	group := ""
+	if i := strings.Index(ref.APIVersion, "/"); i != -1 {
+		group = ref.APIVersion[:i]
+	}
+	return (selector.Group == "" || selector.Group == group) &&
+		(selector.Kind == "" || selector.Kind == ref.Kind) &&
+		(selector.Name == "" || selector.Name == ref.Name) &&
+		(selector.Namespace == "" || selector.Namespace == ref.Namespace)
+}
+
+func resourceRef(item *yaml.Node) ResourceRefStruct {
+	var ref ResourceRefStruct
+	if v := lookup(item, "apiVersion"); v != nil {
+		ref.APIVersion = v.Value
+	}
+	if v := lookup(item, "kind"); v != nil {
+		ref.Kind = v.Value
+	}
+	if metadata := lookup(item, "metadata"); metadata != nil {
+		if v := lookup(metadata, "name"); v != nil {
+			ref.Name = v.Value
+		}
+		if v := lookup(metadata, "namespace"); v != nil {
+			ref.Namespace = v.Value
+		}
+	}
+	return ref
+}
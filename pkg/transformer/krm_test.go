@@ -0,0 +1,114 @@
+package transformer
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+const resourceListItems = `items:
+- apiVersion: v1
+  kind: ConfigMap
+  metadata:
+    name: cm
+    namespace: app
+- apiVersion: apps/v1
+  kind: Deployment
+  metadata:
+    name: web
+    namespace: app
+`
+
+func TestRunResourceList(t *testing.T) {
+	tests := []struct {
+		name           string
+		functionConfig string
+		want           []string // substrings of the output
+		wantErr        bool
+	}{
+		{
+			name: "configmap config",
+			functionConfig: `functionConfig:
+  apiVersion: v1
+  kind: ConfigMap
+  metadata:
+    name: labels
+  data:
+    labels: "team=a, tier=web"
+    annotations: owner=ops
+`,
+			want: []string{"      labels:\n        team: a\n        tier: web\n      annotations:\n        owner: ops\n"},
+		},
+		{
+			name: "custom resource config with include",
+			functionConfig: `functionConfig:
+  apiVersion: labeler.io/v1
+  kind: Labels
+  metadata:
+    name: labels
+  spec:
+    labels:
+      team: a
+    include:
+    - group: apps
+`,
+			want: []string{
+				"      name: web\n      namespace: app\n      labels:\n        team: a\n",
+				"message: 'skipped: not included by functionConfig'",
+				"severity: info",
+			},
+		},
+		{
+			name: "exclude",
+			functionConfig: `functionConfig:
+  apiVersion: labeler.io/v1
+  kind: Labels
+  spec:
+    labels:
+      team: a
+    exclude:
+    - kind: ConfigMap
+      name: cm
+`,
+			want: []string{"message: 'skipped: excluded by functionConfig'", "      name: web\n      namespace: app\n      labels:\n"},
+		},
+		{
+			name:           "missing functionConfig",
+			functionConfig: "",
+			want:           []string{"message: functionConfig is missing", "severity: error"},
+			wantErr:        true,
+		},
+		{
+			name: "functionConfig without labels",
+			functionConfig: `functionConfig:
+  apiVersion: v1
+  kind: ConfigMap
+  data: {}
+`,
+			want:    []string{"message: functionConfig has no labels or annotations"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			input := "apiVersion: config.kubernetes.io/v1\nkind: ResourceList\n" + tt.functionConfig + resourceListItems
+			var out bytes.Buffer
+			err := RunResourceList(strings.NewReader(input), &out)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("RunResourceList() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(out.String(), want) {
+					t.Errorf("RunResourceList() output does not contain %q:\n%s", want, out.String())
+				}
+			}
+		})
+	}
+}
+
+func TestRunResourceListRejectsOtherInput(t *testing.T) {
+	var out bytes.Buffer
+	if err := RunResourceList(strings.NewReader("apiVersion: v1\nkind: ConfigMap\n"), &out); err == nil {
+		t.Error("RunResourceList() of a ConfigMap did not fail")
+	}
+}
@@ -0,0 +1,157 @@
+package transformer
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// OptionsStruct holds the metadata to inject into manifests
+type OptionsStruct struct {
+	Labels       map[string]string
+	Annotations  map[string]string
+	PodTemplates bool // also label and annotate the pod templates of workloads (spec.template, spec.jobTemplate)
+}
+
+// Transform reads a stream of YAML (or JSON) documents from r, adds the labels and annotations to the metadata of
+// every object, and writes the documents to w in the same order. Comments are preserved. Documents that are not
+// Kubernetes objects are written unchanged, List documents have their items transformed. JSON input (a stream of
+// JSON objects, as kubectl get -o json prints them) is written as JSON.
+func Transform(r io.Reader, w io.Writer, opts OptionsStruct) error {
+	br := bufio.NewReader(r)
+	if isJSONStream(br) {
+		return transformJSON(br, w, opts)
+	}
+	decoder := yaml.NewDecoder(br)
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	for {
+		var doc yaml.Node
+		err := decoder.Decode(&doc)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if len(doc.Content) > 0 {
+			TransformObject(doc.Content[0], opts)
+		}
+		if err := encoder.Encode(&doc); err != nil {
+			return err
+		}
+	}
+	return encoder.Close()
+}
+
+// TransformObject adds the labels and annotations to a single object node
+func TransformObject(obj *yaml.Node, opts OptionsStruct) {
+	if obj.Kind != yaml.MappingNode || lookup(obj, "kind") == nil {
+		return
+	}
+	if kind := lookup(obj, "kind"); strings.HasSuffix(kind.Value, "List") {
+		if items := lookup(obj, "items"); items != nil && items.Kind == yaml.SequenceNode {
+			for _, item := range items.Content {
+				TransformObject(item, opts)
+			}
+			return
+		}
+	}
+	setMetadata(mapping(obj, "metadata"), opts)
+
+	if !opts.PodTemplates {
+		return
+	}
+	spec := lookup(obj, "spec")
+	if spec == nil || spec.Kind != yaml.MappingNode {
+		return
+	}
+	if template := lookup(spec, "template"); template != nil && template.Kind == yaml.MappingNode {
+		setMetadata(mapping(template, "metadata"), withoutSelectorKeys(spec, opts))
+	}
+	// CronJobs carry a job template that in turn carries a pod template
+	if jobTemplate := lookup(spec, "jobTemplate"); jobTemplate != nil && jobTemplate.Kind == yaml.MappingNode {
+		setMetadata(mapping(jobTemplate, "metadata"), opts)
+		if jobSpec := lookup(jobTemplate, "spec"); jobSpec != nil && jobSpec.Kind == yaml.MappingNode {
+			if template := lookup(jobSpec, "template"); template != nil && template.Kind == yaml.MappingNode {
+				setMetadata(mapping(template, "metadata"), opts)
+			}
+		}
+	}
+}
+
+// withoutSelectorKeys drops labels that the workload selects its pods by, changing those on the pod template would
+// make the template no longer match the selector
+func withoutSelectorKeys(spec *yaml.Node, opts OptionsStruct) OptionsStruct {
+	selector := lookup(spec, "selector")
+	if selector == nil || selector.Kind != yaml.MappingNode {
+		return opts
+	}
+	if matchLabels := lookup(selector, "matchLabels"); matchLabels != nil {
+		selector = matchLabels
+	}
+	labels := map[string]string{}
+	for k, v := range opts.Labels {
+		if lookup(selector, k) == nil {
+			labels[k] = v
+		}
+	}
+	opts.Labels = labels
+	return opts
+}
+
+func setMetadata(metadata *yaml.Node, opts OptionsStruct) {
+	if len(opts.Labels) > 0 {
+		setValues(mapping(metadata, "labels"), opts.Labels)
+	}
+	if len(opts.Annotations) > 0 {
+		setValues(mapping(metadata, "annotations"), opts.Annotations)
+	}
+}
+
+func setValues(m *yaml.Node, values map[string]string) {
+	var keys []string
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		// the !!str tag keeps values like "true" or "1" strings, as metadata requires
+		value := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: values[k]}
+		if existing := lookup(m, k); existing != nil {
+			*existing = *value
+			continue
+		}
+		m.Content = append(m.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: k}, value)
+	}
+}
+
+// lookup returns the value of a key in a mapping node, or nil
+func lookup(m *yaml.Node, key string) *yaml.Node {
+	if m.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			return m.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// mapping returns the mapping stored under key, creating it (or replacing a null value) when needed
+func mapping(m *yaml.Node, key string) *yaml.Node {
+	if existing := lookup(m, key); existing != nil {
+		if existing.Kind != yaml.MappingNode {
+			*existing = yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		}
+		return existing
+	}
+	value := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	m.Content = append(m.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, value)
+	return value
+}
@@ -0,0 +1,207 @@
+package transformer
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestTransform(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		opts  OptionsStruct
+		want  string
+	}{
+		{
+			name: "labels and annotations keep comments",
+			input: `# the app
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app # the name
+  labels:
+    app: x
+`,
+			opts: OptionsStruct{Labels: map[string]string{"app": "y", "team": "a"}, Annotations: map[string]string{"replicas": "1"}},
+			want: `# the app
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app # the name
+  labels:
+    app: y
+    team: a
+  annotations:
+    replicas: "1"
+`,
+		},
+		{
+			name: "pod templates without the selector keys",
+			input: `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  selector:
+    matchLabels:
+      app: x
+  template:
+    metadata:
+      labels:
+        app: x
+`,
+			opts: OptionsStruct{Labels: map[string]string{"app": "y", "team": "a"}, PodTemplates: true},
+			want: `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+  labels:
+    app: y
+    team: a
+spec:
+  selector:
+    matchLabels:
+      app: x
+  template:
+    metadata:
+      labels:
+        app: x
+        team: a
+`,
+		},
+		{
+			name: "cronjob templates",
+			input: `apiVersion: batch/v1
+kind: CronJob
+metadata:
+  name: job
+spec:
+  jobTemplate:
+    spec:
+      template:
+        spec: {}
+`,
+			opts: OptionsStruct{Labels: map[string]string{"team": "a"}, PodTemplates: true},
+			want: `apiVersion: batch/v1
+kind: CronJob
+metadata:
+  name: job
+  labels:
+    team: a
+spec:
+  jobTemplate:
+    spec:
+      template:
+        spec: {}
+        metadata:
+          labels:
+            team: a
+    metadata:
+      labels:
+        team: a
+`,
+		},
+		{
+			name: "list items and documents that are not objects",
+			input: `apiVersion: v1
+kind: List
+items:
+- apiVersion: v1
+  kind: ConfigMap
+  metadata:
+    name: cm
+---
+NOTES: not an object
+`,
+			opts: OptionsStruct{Labels: map[string]string{"team": "a"}},
+			want: `apiVersion: v1
+kind: List
+items:
+  - apiVersion: v1
+    kind: ConfigMap
+    metadata:
+      name: cm
+      labels:
+        team: a
+---
+NOTES: not an object
+`,
+		},
+		{
+			name:  "json stream stays json",
+			input: "\n" + `{"apiVersion":"v1","kind":"ConfigMap","metadata":{"name":"cm","labels":null},"data":{"replicas":"2","html":"<a>"}}` + "\n" + `{"kind":"Secret","apiVersion":"v1","metadata":{"name":"s"},"immutable":true,"spec":{"size":1.5,"count":3,"items":[]}}`,
+			opts:  OptionsStruct{Labels: map[string]string{"team": "a"}, Annotations: map[string]string{"replicas": "1"}},
+			want: `{
+    "apiVersion": "v1",
+    "kind": "ConfigMap",
+    "metadata": {
+        "name": "cm",
+        "labels": {
+            "team": "a"
+        },
+        "annotations": {
+            "replicas": "1"
+        }
+    },
+    "data": {
+        "replicas": "2",
+        "html": "\u003ca\u003e"
+    }
+}
+{
+    "kind": "Secret",
+    "apiVersion": "v1",
+    "metadata": {
+        "name": "s",
+        "labels": {
+            "team": "a"
+        },
+        "annotations": {
+            "replicas": "1"
+        }
+    },
+    "immutable": true,
+    "spec": {
+        "size": 1.5,
+        "count": 3,
+        "items": []
+    }
+}
+`,
+		},
+		{
+			name:  "json list",
+			input: `{"apiVersion":"v1","kind":"List","items":[{"apiVersion":"v1","kind":"ConfigMap","metadata":{"name":"cm"}}]}`,
+			opts:  OptionsStruct{Labels: map[string]string{"team": "a"}},
+			want: `{
+    "apiVersion": "v1",
+    "kind": "List",
+    "items": [
+        {
+            "apiVersion": "v1",
+            "kind": "ConfigMap",
+            "metadata": {
+                "name": "cm",
+                "labels": {
+                    "team": "a"
+                }
+            }
+        }
+    ]
+}
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			if err := Transform(strings.NewReader(tt.input), &out, tt.opts); err != nil {
+				t.Fatal(err)
+			}
+			if out.String() != tt.want {
+				t.Errorf("Transform() =\n%s\nwant:\n%s", out.String(), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,202 @@
+package undoJournal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	c "github.com/clubanderson/labeler/pkg/common"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// ChangeStruct is a single label or annotation value changed by a run. Before is nil when the key did not exist.
+// Restored is set once labeler undo has reverted the change.
+type ChangeStruct struct {
+	Resource c.ResourceStruct `json:"resource"`
+	Field    string           `json:"field"`
+	Key      string           `json:"key"`
+	Before   *string          `json:"before"`
+	After    string           `json:"after"`
+	Restored bool             `json:"restored,omitempty"`
+}
+
+// EntryStruct is the journal of one labeling run
+type EntryStruct struct {
+	RunID     string         `json:"runID"`
+	Context   string         `json:"context"`
+	Command   string         `json:"command,omitempty"`
+	Timestamp time.Time      `json:"timestamp"`
+	Undone    bool           `json:"undone,omitempty"`
+	Changes   []ChangeStruct `json:"changes"`
+}
+
+// MarkRestored records that change i of the run was reverted. The run is undone once all of its changes are.
+func (e *EntryStruct) MarkRestored(i int) {
+	e.Changes[i].Restored = true
+	for _, change := range e.Changes {
+		if !change.Restored {
+			return
+		}
+	}
+	e.Undone = true
+}
+
+// changes recorded by the current run
+var changes []ChangeStruct
+
+// Record adds a change made by the current run to the journal
+func Record(change ChangeStruct) {
+	changes = append(changes, change)
+}
+
+// Mark returns the number of changes recorded so far, to be passed to Since or Truncate
+func Mark() int {
+	return len(changes)
+}
+
+// Since returns the changes recorded after a mark
+func Since(mark int) []ChangeStruct {
+	return append([]ChangeStruct{}, changes[mark:]...)
+}
+
+// Truncate forgets the changes recorded after a mark, e.g. because they were rolled back
+func Truncate(mark int) {
+	changes = changes[:mark]
+}
+
+// Finish returns the journal entry for the current run, or false if the run did not change anything
+func Finish(contextName, command string) (EntryStruct, bool) {
+	if len(changes) == 0 {
+		return EntryStruct{}, false
+	}
+	now := time.Now()
+	return EntryStruct{
+		RunID:     fmt.Sprintf("%v-%04x", now.Format("20060102-150405"), rand.Intn(0x10000)),
+		Context:   contextName,
+		Command:   command,
+		Timestamp: now,
+		Changes:   changes,
+	}, true
+}
+
+func journalDir(homeDir string) string {
+	return filepath.Join(c.StateDir(homeDir), "journal")
+}
+
+// Save writes a journal entry to the user's home directory
+func Save(homeDir string, e EntryStruct) error {
+	if err := os.MkdirAll(journalDir(homeDir), 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(journalDir(homeDir), e.RunID+".json"), data, 0600)
+}
+
+// Load reads the journal entry of a run from the user's home directory
+func Load(homeDir, runID string) (EntryStruct, error) {
+	var e EntryStruct
+	data, err := os.ReadFile(filepath.Join(journalDir(homeDir), runID+".json"))
+	if err != nil {
+		return e, err
+	}
+	err = json.Unmarshal(data, &e)
+	return e, err
+}
+
+// Latest returns the most recent run against a context that has not been undone
+func Latest(homeDir, contextName string) (EntryStruct, error) {
+	files, err := os.ReadDir(journalDir(homeDir))
+	if err != nil && !os.IsNotExist(err) {
+		return EntryStruct{}, err
+	}
+	var runIDs []string
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), ".json") {
+			runIDs = append(runIDs, strings.TrimSuffix(file.Name(), ".json"))
+		}
+	}
+	// run IDs start with a timestamp, so the newest sorts last
+	sort.Sort(sort.Reverse(sort.StringSlice(runIDs)))
+	for _, runID := range runIDs {
+		e, err := Load(homeDir, runID)
+		if err != nil {
+			continue
+		}
+		if e.Context == contextName && !e.Undone {
+			return e, nil
+		}
+	}
+	return EntryStruct{}, fmt.Errorf("no journal entry found for context %q", contextName)
+}
+
+// SaveToConfigMap stores a journal entry in an in-cluster ConfigMap, keyed by run ID, creating the ConfigMap if needed
+func SaveToConfigMap(clientset kubernetes.Interface, namespace, name string, e EntryStruct) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	cm, err := clientset.CoreV1().ConfigMaps(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		cm = &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+			Data:       map[string]string{e.RunID: string(data)},
+		}
+		_, err = clientset.CoreV1().ConfigMaps(namespace).Create(context.TODO(), cm, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if cm.Data == nil {
+		cm.Data = map[string]string{}
+	}
+	cm.Data[e.RunID] = string(data)
+	_, err = clientset.CoreV1().ConfigMaps(namespace).Update(context.TODO(), cm, metav1.UpdateOptions{})
+	return err
+}
+
+// LoadFromConfigMap reads a journal entry from an in-cluster ConfigMap. An empty run ID returns the most recent
+// entry for the context that has not been undone.
+func LoadFromConfigMap(clientset kubernetes.Interface, namespace, name, runID, contextName string) (EntryStruct, error) {
+	var e EntryStruct
+	cm, err := clientset.CoreV1().ConfigMaps(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		return e, err
+	}
+	if runID != "" {
+		data, ok := cm.Data[runID]
+		if !ok {
+			return e, fmt.Errorf("run %q not found in configmap %v/%v", runID, namespace, name)
+		}
+		err = json.Unmarshal([]byte(data), &e)
+		return e, err
+	}
+	var runIDs []string
+	for id := range cm.Data {
+		runIDs = append(runIDs, id)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(runIDs)))
+	for _, id := range runIDs {
+		var candidate EntryStruct
+		if json.Unmarshal([]byte(cm.Data[id]), &candidate) != nil {
+			continue
+		}
+		if candidate.Context == contextName && !candidate.Undone {
+			return candidate, nil
+		}
+	}
+	return e, fmt.Errorf("no journal entry found for context %q in configmap %v/%v", contextName, namespace, name)
+}
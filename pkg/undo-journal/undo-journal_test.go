@@ -0,0 +1,62 @@
+package undoJournal
+
+import (
+	"testing"
+
+	c "github.com/clubanderson/labeler/pkg/common"
+)
+
+func TestMarkRestored(t *testing.T) {
+	before := "old"
+	newEntry := func() EntryStruct {
+		return EntryStruct{
+			RunID:   "20261019-101010-abcd",
+			Context: "kind-kind",
+			Changes: []ChangeStruct{
+				{Resource: c.ResourceStruct{Version: "v1", Resource: "services", Namespace: "default", ObjectName: "a"}, Field: "labels", Key: "app", After: "x"},
+				{Resource: c.ResourceStruct{Version: "v1", Resource: "services", Namespace: "default", ObjectName: "b"}, Field: "labels", Key: "app", Before: &before, After: "x"},
+				{Resource: c.ResourceStruct{Version: "v1", Resource: "services", Namespace: "default", ObjectName: "b"}, Field: "annotations", Key: "note", After: "y"},
+			},
+		}
+	}
+
+	tests := []struct {
+		name       string
+		restore    []int
+		wantUndone bool
+	}{
+		{name: "nothing restored", wantUndone: false},
+		{name: "some restored", restore: []int{2, 0}, wantUndone: false},
+		{name: "all restored", restore: []int{2, 1, 0}, wantUndone: true},
+		{name: "restored twice", restore: []int{0, 0, 1}, wantUndone: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newEntry()
+			for _, i := range tt.restore {
+				e.MarkRestored(i)
+			}
+			if e.Undone != tt.wantUndone {
+				t.Errorf("Undone = %v, want %v", e.Undone, tt.wantUndone)
+			}
+
+			// what was restored survives saving the journal, so that undoing again skips it
+			home := t.TempDir()
+			if err := Save(home, e); err != nil {
+				t.Fatal(err)
+			}
+			loaded, err := Load(home, e.RunID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, change := range loaded.Changes {
+				if change.Restored != e.Changes[i].Restored {
+					t.Errorf("change %d restored = %v, want %v", i, change.Restored, e.Changes[i].Restored)
+				}
+			}
+			if _, err := Latest(home, "kind-kind"); (err == nil) == tt.wantUndone {
+				t.Errorf("Latest() error = %v, an undone run must not be returned, a partly undone one must", err)
+			}
+		})
+	}
+}